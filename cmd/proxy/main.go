@@ -30,8 +30,8 @@ func main() {
 	cfg := config.ConfigLoad()
 
 	// Validate proxy configuration
-	if cfg.Proxy.OriginBaseURL == "" {
-		logger.Fatal("Proxy origin base URL is required. Set proxy.origin_base_url in config or PROXY_TARGET environment variable")
+	if cfg.Proxy.OriginBaseURL == "" && len(cfg.Proxy.Origins) == 0 && len(cfg.Proxy.Routes) == 0 {
+		logger.Fatal("Proxy origin is required. Set proxy.origin_base_url, proxy.origins or proxy.routes in config or PROXY_TARGET environment variable")
 	}
 
 	// Create proxy handler
@@ -39,10 +39,55 @@ func main() {
 	if err != nil {
 		logger.Fatal("Failed to create proxy handler", "error", err)
 	}
+	router := proxyHandler.Router()
+	for _, route := range router.Routes() {
+		for _, origin := range route.Pool.Origins() {
+			logger.Info("Proxy origin", "route", route.Name, "url", origin.URL.String(), "weight", origin.Weight)
+		}
+	}
+	origins := 0
+	for _, pool := range router.Pools() {
+		origins += len(pool.Origins())
+	}
+	logger.Info("Load balancing", "strategy", cfg.Proxy.LoadBalancing.Strategy, "routes", len(router.Routes()), "origins", origins)
+
+	for _, pool := range router.Pools() {
+		healthChecker, err := proxy.NewHealthChecker(pool, proxyHandler.Transport(), &cfg.Proxy.HealthCheck)
+		if err != nil {
+			logger.Fatal("Failed to create health checker", "error", err)
+		}
+		if healthChecker != nil {
+			healthChecker.Start()
+		}
+	}
+	if cfg.Proxy.HealthCheck.Path != "" {
+		logger.Info("Upstream health checks enabled",
+			"probe", cfg.Proxy.HealthCheck.Path,
+			"interval", cfg.Proxy.HealthCheck.Interval)
+	}
+	if cfg.Proxy.LoadBalancing.StatsInterval != "" {
+		if interval, err := time.ParseDuration(cfg.Proxy.LoadBalancing.StatsInterval); err == nil && interval > 0 {
+			for _, pool := range router.Pools() {
+				go pool.LogStats(interval)
+			}
+		}
+	}
 
 	// Build middleware chain (order matters!)
 	var handler http.Handler = proxyHandler
 
+	// Answer cacheable requests from the shared response cache
+	cache, err := proxy.NewResponseCache(&cfg.Proxy.Cache)
+	if err != nil {
+		logger.Fatal("Failed to create proxy cache", "error", err)
+	}
+	if cache != nil {
+		handler = cache.Middleware(handler)
+		logger.Info("Proxy response cache enabled",
+			"max_bytes", cfg.Proxy.Cache.MaxBytes,
+			"disk_dir", cfg.Proxy.Cache.DiskDir)
+	}
+
 	// Add security headers (applies to all responses)
 	handler = middleware.SecurityHeadersMiddleware(handler)
 
@@ -71,12 +116,19 @@ func main() {
 			"block_duration", blockDuration.String())
 	}
 
-	// Add health check endpoint (bypasses auth)
+	// Add health check and readiness endpoints (bypass auth)
 	handler = proxy.HealthCheckMiddleware(handler)
+	handler = proxy.ReadinessMiddleware(router.Pools()...)(handler)
+	if cache != nil && cfg.Proxy.Cache.PurgeToken != "" {
+		handler = proxy.PurgeMiddleware(cache, cfg.Proxy.Cache.PurgePath, cfg.Proxy.Cache.PurgeToken)(handler)
+	}
 
 	// Add request validation (size limiting, host validation, etc.)
 	handler = proxy.RequestValidationMiddleware(cfg.Proxy.AllowedHost, cfg.Proxy.MaxRequestSize)(handler)
 
+	// Resolve the route first, validation and auth depend on it
+	handler = proxy.RouteMiddleware(router)(handler)
+
 	// Apply rate limiting if enabled
 	if cfg.RateLimit.Enabled {
 		if proxyLimiter != nil {
@@ -117,7 +169,7 @@ func main() {
 		logger.Info("Starting HTTPS proxy server",
 			"address", cfg.ListenAddr,
 			"port", cfg.ListenPort,
-			"target", cfg.Proxy.OriginBaseURL,
+			"origins", origins,
 			"cert", cfg.TLS.CertFile,
 			"key", cfg.TLS.KeyFile)
 
@@ -130,7 +182,7 @@ func main() {
 		logger.Info("Starting HTTP proxy server",
 			"address", cfg.ListenAddr,
 			"port", cfg.ListenPort,
-			"target", cfg.Proxy.OriginBaseURL)
+			"origins", origins)
 		ln, err := net.Listen(network, httpServer.Addr)
 		if err != nil {
 			logger.Fatal("Failed to listen", "error", err)
@@ -4,14 +4,12 @@ import (
 	"flag"
 	"net"
 	"net/http"
-	"path/filepath"
+	"os"
 	"time"
 
 	"github.com/ezhttp/ezhttp/internal/config"
 	"github.com/ezhttp/ezhttp/internal/logger"
 	"github.com/ezhttp/ezhttp/internal/middleware"
-	"github.com/ezhttp/ezhttp/internal/ratelimit"
-	"github.com/ezhttp/ezhttp/internal/security"
 	"github.com/ezhttp/ezhttp/internal/server"
 	tlsconfig "github.com/ezhttp/ezhttp/internal/tls"
 	"github.com/ezhttp/ezhttp/internal/version"
@@ -37,11 +35,21 @@ import (
 var cfg config.DataConfig
 
 // Internal
-var compiledCsp string = ""
-var cachedIndexString []string = []string{}
 var minifier *minify.M
 
 func main() {
+	// Subcommands print their output on stdout, so logs go to stderr
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "sign-url":
+			logger.SetOutput(os.Stderr)
+			os.Exit(runSignURL(os.Args[2:]))
+		case "manifest":
+			logger.SetOutput(os.Stderr)
+			os.Exit(runManifest(os.Args[2:]))
+		}
+	}
+
 	// Flag Check
 	showVersion := flag.Bool("version", false, "show version")
 	flag.Parse()
@@ -55,10 +63,6 @@ func main() {
 	// Load Config
 	cfg = config.ConfigLoad()
 
-	// Cache Generated Index and CSP
-	cachedIndexString, _ = server.LoadIndexCache()
-	compiledCsp = cfg.Csp.Compile()
-
 	// Set Up Minification
 	minifier = minify.New()
 	// TODO: Had issues with the other minifiers but will revisit
@@ -75,45 +79,26 @@ func main() {
 	// minifier.AddFuncRegexp(regexp.MustCompile("^(application|text)/(x-)?(java|ecma)script$"), js.Minify)
 	// minifier.AddFuncRegexp(regexp.MustCompile("^application/json$"), json.Minify)
 
-	// Create secure file server with custom FileSystem
-	publicDir, err := filepath.Abs("./public")
-	if err != nil {
-		logger.Fatal("Failed to resolve public directory")
-	}
-
-	// Use a custom FileSystem that prevents directory listings and symlink attacks
-	secureFS := &security.SecureFileSystem{
-		Fs:      http.Dir(publicDir),
-		BaseDir: publicDir,
+	// Create one site per virtual host (or a single default site)
+	sites := make([]*server.Site, 0, len(cfg.Sites)+1)
+	for _, siteCfg := range cfg.SiteConfigs() {
+		site, err := server.NewSite(siteCfg, minifier)
+		if err != nil {
+			logger.Fatal("Failed to create site", "site", siteCfg.Name, "error", err)
+		}
+		logger.Info("Site configured", "site", site.Name, "hosts", site.Hosts, "default", site.Default)
+		sites = append(sites, site)
 	}
-	httpfs := http.FileServer(secureFS)
 
-	// Create file existence cache with 5-minute TTL
-	fileCache, err := server.NewFileExistenceCache(publicDir, 5*time.Minute)
-	if err != nil {
-		logger.Fatal("Failed to create file cache", "error", err)
-	}
-	// Pre-warm cache with common paths
-	fileCache.PrewarmCommonPaths()
+	// Allow toggling maintenance mode at runtime
+	watchMaintenanceSignal(sites)
 
 	// Create handler chain
-	var handler http.Handler = server.MwNonce(httpfs, compiledCsp, cachedIndexString, minifier, cfg.Banner, fileCache)
+	var handler http.Handler = server.NewHostRouter(sites)
 
 	// Apply security headers middleware
 	handler = middleware.SecurityHeadersMiddleware(handler)
 
-	// Apply rate limiting if enabled
-	if cfg.RateLimit.Enabled {
-		limiter := ratelimit.NewLimiter(
-			cfg.RateLimit.RequestsPerMinute,
-			cfg.RateLimit.BurstSize,
-		)
-		handler = middleware.RateLimitMiddleware(limiter)(handler)
-		logger.Info("Rate limiting enabled",
-			"requests_per_minute", cfg.RateLimit.RequestsPerMinute,
-			"burst_size", cfg.RateLimit.BurstSize)
-	}
-
 	// Configure server
 	httpServer := &http.Server{
 		Addr:              cfg.ListenAddr + ":" + cfg.ListenPort,
@@ -129,6 +114,7 @@ func main() {
 	network := "tcp4"
 
 	// Start server with or without TLS
+	var err error
 	if cfg.TLS.CertFile != "" && cfg.TLS.KeyFile != "" {
 		// Configure TLS
 		httpServer.TLSConfig = tlsconfig.CreateServerTLSConfig()
@@ -139,16 +125,16 @@ func main() {
 			"cert", cfg.TLS.CertFile,
 			"key", cfg.TLS.KeyFile)
 
-		ln, err := net.Listen(network, httpServer.Addr)
-		if err != nil {
-			logger.Fatal("Failed to listen", "error", err)
+		ln, errListen := net.Listen(network, httpServer.Addr)
+		if errListen != nil {
+			logger.Fatal("Failed to listen", "error", errListen)
 		}
 		err = httpServer.ServeTLS(ln, cfg.TLS.CertFile, cfg.TLS.KeyFile)
 	} else {
 		logger.Info("Starting HTTP server", "address", cfg.ListenAddr, "port", cfg.ListenPort)
-		ln, err := net.Listen(network, httpServer.Addr)
-		if err != nil {
-			logger.Fatal("Failed to listen", "error", err)
+		ln, errListen := net.Listen(network, httpServer.Addr)
+		if errListen != nil {
+			logger.Fatal("Failed to listen", "error", errListen)
 		}
 		err = httpServer.Serve(ln)
 	}
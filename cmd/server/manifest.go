@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/ezhttp/ezhttp/internal/server"
+)
+
+// Produces a signed manifest of a document root for build pipelines
+//
+//	ezhttp manifest -genkey
+//	ezhttp manifest -root ./public -key manifest.key -out manifest.json
+func runManifest(args []string) int {
+	flags := flag.NewFlagSet("manifest", flag.ContinueOnError)
+	rootDir := flags.String("root", "./public", "document root to hash")
+	keyFile := flags.String("key", "", "file containing the base64 ed25519 private key")
+	outFile := flags.String("out", "", "output file (default stdout)")
+	genKey := flags.Bool("genkey", false, "generate a new key pair and exit")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	if *genKey {
+		publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "manifest: failed to generate key:", err)
+			return 1
+		}
+		fmt.Printf("private_key: %s\n", base64.StdEncoding.EncodeToString(privateKey))
+		fmt.Printf("public_key:  %s\n", base64.StdEncoding.EncodeToString(publicKey))
+		return 0
+	}
+
+	if *keyFile == "" {
+		fmt.Fprintln(os.Stderr, "manifest: -key is required")
+		return 2
+	}
+	keyBytes, err := os.ReadFile(*keyFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "manifest: failed to read key:", err)
+		return 1
+	}
+	privateKey, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(keyBytes)))
+	if err != nil || len(privateKey) != ed25519.PrivateKeySize {
+		fmt.Fprintln(os.Stderr, "manifest: invalid private key")
+		return 1
+	}
+
+	manifest, err := server.BuildManifest(*rootDir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "manifest:", err)
+		return 1
+	}
+	signed, err := manifest.Sign(ed25519.PrivateKey(privateKey))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "manifest: failed to sign:", err)
+		return 1
+	}
+	signed = append(signed, '\n')
+
+	if *outFile == "" {
+		os.Stdout.Write(signed)
+		return 0
+	}
+	if err := os.WriteFile(*outFile, signed, 0644); err != nil {
+		fmt.Fprintln(os.Stderr, "manifest: failed to write output:", err)
+		return 1
+	}
+	return 0
+}
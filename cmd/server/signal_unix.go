@@ -0,0 +1,28 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/ezhttp/ezhttp/internal/logger"
+	"github.com/ezhttp/ezhttp/internal/server"
+)
+
+// Toggles maintenance mode on all sites when SIGUSR1 is received, overriding
+// the config and the sentinel file
+func watchMaintenanceSignal(sites []*server.Site) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR1)
+
+	go func() {
+		for range sigs {
+			for _, site := range sites {
+				active := site.Maintenance.Toggle()
+				logger.Info("Maintenance mode toggled by signal", "site", site.Name, "active", active)
+			}
+		}
+	}()
+}
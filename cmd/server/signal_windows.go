@@ -0,0 +1,8 @@
+//go:build windows
+
+package main
+
+import "github.com/ezhttp/ezhttp/internal/server"
+
+// SIGUSR1 does not exist on Windows. Use the sentinel file instead
+func watchMaintenanceSignal(sites []*server.Site) {}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	"github.com/ezhttp/ezhttp/internal/config"
+	"github.com/ezhttp/ezhttp/internal/security"
+)
+
+// Mints a signed link using the secret configured for the path's prefix
+//
+//	ezhttp sign-url -path /media/report.pdf -expires 24h [-ip 203.0.113.7] [-site name] [-base https://example.com]
+func runSignURL(args []string) int {
+	flags := flag.NewFlagSet("sign-url", flag.ContinueOnError)
+	filePath := flags.String("path", "", "path of the file to sign, e.g. /media/report.pdf")
+	expiresIn := flags.Duration("expires", time.Hour, "how long the link stays valid")
+	clientIP := flags.String("ip", "", "bind the link to this client IP")
+	siteName := flags.String("site", "", "site name when virtual hosting is configured")
+	baseURL := flags.String("base", "", "URL prefix to print before the path, e.g. https://example.com")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	if *filePath == "" {
+		fmt.Fprintln(os.Stderr, "sign-url: -path is required")
+		return 2
+	}
+	if *expiresIn <= 0 {
+		fmt.Fprintln(os.Stderr, "sign-url: -expires must be positive")
+		return 2
+	}
+	cleanPath := path.Clean("/" + *filePath)
+
+	cfg := config.ConfigLoad()
+
+	var site *config.DataConfigSite
+	for _, siteCfg := range cfg.SiteConfigs() {
+		if siteCfg.Name == *siteName || (*siteName == "" && siteCfg.Default) {
+			site = &siteCfg
+			break
+		}
+	}
+	if site == nil {
+		fmt.Fprintln(os.Stderr, "sign-url: site not found, use -site")
+		return 1
+	}
+
+	signers := make([]*security.URLSigner, 0, len(site.SignedURLs))
+	for _, signed := range site.SignedURLs {
+		signers = append(signers, security.NewURLSigner(signed.Prefix, signed.Secret, signed.BindIP))
+	}
+	signer := security.MatchURLSigner(signers, cleanPath)
+	if signer == nil {
+		fmt.Fprintf(os.Stderr, "sign-url: no signed_urls prefix covers %s\n", cleanPath)
+		return 1
+	}
+
+	query := signer.Sign(cleanPath, time.Now().Add(*expiresIn), *clientIP)
+	fmt.Printf("%s%s?%s\n", *baseURL, cleanPath, query)
+	return 0
+}
@@ -4,8 +4,14 @@ go 1.24.4
 
 require (
 	dario.cat/mergo v1.0.2
+	github.com/fsnotify/fsnotify v1.9.0
 	github.com/tdewolff/minify/v2 v2.23.8
+	golang.org/x/crypto v0.43.0
+	golang.org/x/image v0.32.0
 	golang.org/x/time v0.12.0
 )
 
-require github.com/tdewolff/parse/v2 v2.8.1 // indirect
+require (
+	github.com/tdewolff/parse/v2 v2.8.1 // indirect
+	golang.org/x/sys v0.37.0 // indirect
+)
@@ -11,15 +11,79 @@ import (
 )
 
 type DataConfig struct {
-	Version          int                 `json:"version"`
-	ListenAddr       string              `json:"listen_addr"`
-	ListenPort       string              `json:"listen_port"`
-	NoncePlaceholder string              `json:"nonce_placeholder"`
-	Banner           []string            `json:"banner"`
-	Csp              DataConfigCsp       `json:"csp"`
-	RateLimit        DataConfigRateLimit `json:"rate_limit"`
-	TLS              DataConfigTLS       `json:"tls"`
-	Proxy            DataConfigProxy     `json:"proxy"`
+	Version          int                        `json:"version"`
+	ListenAddr       string                     `json:"listen_addr"`
+	ListenPort       string                     `json:"listen_port"`
+	NoncePlaceholder string                     `json:"nonce_placeholder"`
+	DocumentRoot     string                     `json:"document_root"`
+	IndexFile        string                     `json:"index_file"`
+	Banner           []string                   `json:"banner"`
+	Csp              DataConfigCsp              `json:"csp"`
+	Headers          map[string]string          `json:"headers"`
+	ClientConfig     map[string]any             `json:"client_config"`
+	Sri              DataConfigSri              `json:"sri"`
+	EarlyHints       bool                       `json:"early_hints"`
+	Maintenance      DataConfigMaintenance      `json:"maintenance"`
+	SignedURLs       []DataConfigSignedURL      `json:"signed_urls"`
+	Auth             DataConfigAuth             `json:"auth"`
+	ContentCache     DataConfigContentCache     `json:"content_cache"`
+	FileCache        DataConfigFileCache        `json:"file_cache"`
+	Manifest         DataConfigManifest         `json:"manifest"`
+	ImageNegotiation DataConfigImageNegotiation `json:"image_negotiation"`
+	ImageResize      DataConfigImageResize      `json:"image_resize"`
+	Languages        DataConfigLanguages        `json:"languages"`
+	IndexVariants    DataConfigIndexVariants    `json:"index_variants"`
+	DirectoryListing DataConfigDirectoryListing `json:"directory_listing"`
+	RateLimit        DataConfigRateLimit        `json:"rate_limit"`
+	TLS              DataConfigTLS              `json:"tls"`
+	Proxy            DataConfigProxy            `json:"proxy"`
+	Sites            []DataConfigSite           `json:"sites"`
+
+	// Values from EZHTTP_PUBLIC_* environment variables, applied last
+	clientConfigEnv map[string]any
+}
+
+// DataConfigSite describes one name-based virtual host. Empty fields are
+// inherited from the top-level configuration, and sections only override the
+// fields they set (see DataConfig.SiteConfigs)
+type DataConfigSite struct {
+	Name             string                      `json:"name"`
+	Hosts            []string                    `json:"hosts"`
+	Default          bool                        `json:"default"`
+	DocumentRoot     string                      `json:"document_root"`
+	IndexFile        string                      `json:"index_file"`
+	NoncePlaceholder string                      `json:"nonce_placeholder"`
+	Banner           []string                    `json:"banner"`
+	Csp              DataConfigCsp               `json:"csp"`
+	Headers          map[string]string           `json:"headers"`
+	ClientConfig     map[string]any              `json:"client_config"`
+	Sri              *DataConfigSri              `json:"sri"`
+	EarlyHints       *bool                       `json:"early_hints"`
+	Maintenance      *DataConfigMaintenance      `json:"maintenance"`
+	SignedURLs       []DataConfigSignedURL       `json:"signed_urls"`
+	Auth             *DataConfigAuth             `json:"auth"`
+	ContentCache     *DataConfigContentCache     `json:"content_cache"`
+	FileCache        *DataConfigFileCache        `json:"file_cache"`
+	Manifest         *DataConfigManifest         `json:"manifest"`
+	ImageNegotiation *DataConfigImageNegotiation `json:"image_negotiation"`
+	ImageResize      *DataConfigImageResize      `json:"image_resize"`
+	Languages        *DataConfigLanguages        `json:"languages"`
+	IndexVariants    *DataConfigIndexVariants    `json:"index_variants"`
+	DirectoryListing *DataConfigDirectoryListing `json:"directory_listing"`
+	RateLimit        *DataConfigRateLimit        `json:"rate_limit"`
+
+	// Raw JSON of each section, so partial sections can be decoded over the
+	// top-level ones
+	sections map[string]json.RawMessage
+}
+
+// UnmarshalJSON keeps the raw sections next to the decoded fields
+func (s *DataConfigSite) UnmarshalJSON(data []byte) error {
+	type plain DataConfigSite
+	if err := json.Unmarshal(data, (*plain)(s)); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &s.sections)
 }
 
 type DataConfigCsp struct {
@@ -46,6 +110,166 @@ type DataConfigRateLimit struct {
 	CleanupInterval   string `json:"cleanup_interval"`
 }
 
+// DataConfigSri controls Subresource Integrity handling for the index
+// template. WarnRemote is on unless set to false
+type DataConfigSri struct {
+	Enabled       bool  `json:"enabled"`
+	FailOnMissing bool  `json:"fail_on_missing"`
+	WarnRemote    *bool `json:"warn_remote"`
+}
+
+// WarnRemoteOrDefault returns WarnRemote, true when unset
+func (s *DataConfigSri) WarnRemoteOrDefault() bool {
+	return s.WarnRemote == nil || *s.WarnRemote
+}
+
+// DataConfigMaintenance controls maintenance mode. Besides Enabled, the mode
+// can be switched on by creating SentinelFile or sending SIGUSR1
+type DataConfigMaintenance struct {
+	Enabled      bool     `json:"enabled"`
+	SentinelFile string   `json:"sentinel_file"`
+	Page         string   `json:"page"`
+	RetryAfter   string   `json:"retry_after"`
+	BypassToken  string   `json:"bypass_token"`
+	BypassCookie string   `json:"bypass_cookie"`
+	BypassHeader string   `json:"bypass_header"`
+	AllowCIDRs   []string `json:"allow_cidrs"`
+}
+
+// DataConfigSignedURL protects a path prefix with HMAC-signed, expiring URLs
+type DataConfigSignedURL struct {
+	Prefix string `json:"prefix"`
+	Secret string `json:"secret"`
+	BindIP bool   `json:"bind_ip"`
+}
+
+// DataConfigAuth protects path prefixes of the static server with HTTP Basic
+// (htpasswd file with bcrypt or argon2 hashes) or Bearer token authentication
+type DataConfigAuth struct {
+	Realm           string               `json:"realm"`
+	UsersFile       string               `json:"users_file"`
+	Tokens          []string             `json:"tokens"`
+	Rules           []DataConfigAuthRule `json:"rules"`
+	MaxAuthAttempts int                  `json:"max_auth_attempts"`
+	BlockDuration   string               `json:"block_duration"`
+}
+
+// DataConfigAuthRule requires authentication below Prefix. Users limits
+// access to the listed users (tokens are then rejected). Public exempts a
+// nested prefix from an outer rule
+type DataConfigAuthRule struct {
+	Prefix string   `json:"prefix"`
+	Users  []string `json:"users"`
+	Public bool     `json:"public"`
+}
+
+// DataConfigContentCache controls the in-memory cache for small static files
+type DataConfigContentCache struct {
+	Enabled            bool   `json:"enabled"`
+	MaxBytes           int64  `json:"max_bytes"`
+	MaxFileSize        int64  `json:"max_file_size"`
+	RevalidateInterval string `json:"revalidate_interval"`
+}
+
+// DataConfigFileCache controls the file existence cache used to decide
+// between serving a static file and the SPA index. The document root is
+// watched for changes unless Watch is false. Hit and miss counters are logged
+// every StatsInterval ("0" disables)
+type DataConfigFileCache struct {
+	PositiveTTL   string `json:"positive_ttl"`
+	NegativeTTL   string `json:"negative_ttl"`
+	MaxEntries    int    `json:"max_entries"`
+	Watch         *bool  `json:"watch"`
+	StatsInterval string `json:"stats_interval"`
+}
+
+// WatchOrDefault returns Watch, true when unset
+func (fc *DataConfigFileCache) WatchOrDefault() bool {
+	return fc.Watch == nil || *fc.Watch
+}
+
+// DataConfigManifest hashes the document root at startup and serves only
+// those files. SignedFile is a manifest produced by "ezhttp manifest" at build
+// time, verified with the base64 ed25519 PublicKey. Strict refuses to start
+// when any file fails verification instead of just not serving it
+type DataConfigManifest struct {
+	Enabled    bool   `json:"enabled"`
+	SignedFile string `json:"signed_file"`
+	PublicKey  string `json:"public_key"`
+	Strict     bool   `json:"strict"`
+}
+
+// DataConfigImageNegotiation serves .avif/.webp siblings of .jpg/.png/.gif
+// images below Prefixes to clients whose Accept header lists them. Formats
+// are tried in order
+type DataConfigImageNegotiation struct {
+	Prefixes []string `json:"prefixes"`
+	Formats  []string `json:"formats"`
+}
+
+// DataConfigImageResize serves resized JPEG/PNG images below Prefixes for
+// "?w=480&q=75" requests. Only the listed Widths and Qualities are accepted,
+// at most MaxConcurrent images are resized at once, and renditions are kept
+// in CacheDir up to CacheMaxBytes. Sources larger than MaxSourcePixels are
+// never decoded
+type DataConfigImageResize struct {
+	Prefixes        []string `json:"prefixes"`
+	Widths          []int    `json:"widths"`
+	Qualities       []int    `json:"qualities"`
+	DefaultQuality  int      `json:"default_quality"`
+	MaxConcurrent   int      `json:"max_concurrent"`
+	MaxSourcePixels int64    `json:"max_source_pixels"`
+	CacheDir        string   `json:"cache_dir"`
+	CacheMaxBytes   int64    `json:"cache_max_bytes"`
+}
+
+// DataConfigLanguages serves localized index templates. Each language in
+// Available is loaded from the index file with the language inserted before
+// the extension (index.de.html). The language is taken from the URL prefix
+// (/de/...) unless URLPrefix is false, then the Cookie, then Accept-Language,
+// falling back to Default
+type DataConfigLanguages struct {
+	Available []string `json:"available"`
+	Default   string   `json:"default"`
+	Cookie    string   `json:"cookie"`
+	URLPrefix *bool    `json:"url_prefix"`
+}
+
+// URLPrefixOrDefault returns URLPrefix, true when unset
+func (l *DataConfigLanguages) URLPrefixOrDefault() bool {
+	return l.URLPrefix == nil || *l.URLPrefix
+}
+
+// DataConfigIndexVariants splits users between index templates for A/B tests
+// and canary rollouts. Users are assigned by Weight and kept on their variant
+// by a cookie signed with Secret (random per start when empty). QueryParam
+// forces a variant, including ones with weight 0. The served variant is
+// reported in Header
+type DataConfigIndexVariants struct {
+	Variants     []DataConfigIndexVariant `json:"variants"`
+	Cookie       string                   `json:"cookie"`
+	CookieMaxAge string                   `json:"cookie_max_age"`
+	Secret       string                   `json:"secret"`
+	QueryParam   string                   `json:"query_param"`
+	Header       string                   `json:"header"`
+}
+
+// DataConfigIndexVariant is one named index template. An empty IndexFile
+// means the site's regular (possibly localized) index
+type DataConfigIndexVariant struct {
+	Name      string `json:"name"`
+	IndexFile string `json:"index_file"`
+	Weight    int    `json:"weight"`
+}
+
+// DataConfigDirectoryListing lists directories without an index.html below
+// Prefixes, as HTML or as JSON for "Accept: application/json", PageSize
+// entries at a time
+type DataConfigDirectoryListing struct {
+	Prefixes []string `json:"prefixes"`
+	PageSize int      `json:"page_size"`
+}
+
 type DataConfigTLS struct {
 	CertFile string `json:"cert_file"`
 	KeyFile  string `json:"key_file"`
@@ -63,6 +287,232 @@ type DataConfigProxy struct {
 	MaxAuthAttempts        int    `json:"max_auth_attempts"`
 	BlockDuration          string `json:"block_duration"`
 	DebugMode              bool   `json:"debug_mode"`
+
+	// DialTimeout and TLSHandshakeTimeout bound connecting to an origin,
+	// ResponseHeaderTimeout each attempt until the response headers arrive
+	// and RequestTimeout the whole request including retries (empty = no
+	// limit). The body of a streamed response is not limited
+	DialTimeout           string `json:"dial_timeout"`
+	TLSHandshakeTimeout   string `json:"tls_handshake_timeout"`
+	ResponseHeaderTimeout string `json:"response_header_timeout"`
+	RequestTimeout        string `json:"request_timeout"`
+
+	// Each write of a streamed response (Server-Sent Events, chunked) must
+	// finish within StreamWriteTimeout, which replaces the server's fixed
+	// write timeout for streams
+	StreamWriteTimeout string `json:"stream_write_timeout"`
+
+	Origins        []DataConfigProxyOrigin  `json:"origins"`
+	LoadBalancing  DataConfigLoadBalancing  `json:"load_balancing"`
+	HealthCheck    DataConfigHealthCheck    `json:"health_check"`
+	Routes         []DataConfigProxyRoute   `json:"routes"`
+	Upgrade        DataConfigUpgrade        `json:"upgrade"`
+	Retry          DataConfigRetry          `json:"retry"`
+	CircuitBreaker DataConfigCircuitBreaker `json:"circuit_breaker"`
+	Cache          DataConfigProxyCache     `json:"cache"`
+	Headers        DataConfigHeaderRules    `json:"headers"`
+	Cookies        DataConfigCookies        `json:"cookies"`
+}
+
+// DataConfigProxyRoute sends requests matching Host (optional, exact or
+// "*.example.com") and path Prefix to its own Origins, or to the top-level
+// pool when it has none. The most specific route wins. StripPrefix removes
+// the prefix before forwarding and AddPrefix is prepended afterwards. Empty
+// settings fall back to the top-level ones; RequireAuth false exempts the
+// route from the proxy auth token. Timeout and ResponseHeaderTimeout
+// override the top-level RequestTimeout and ResponseHeaderTimeout. WriteTimeout
+// extends the server's read and write deadlines for long-polling and
+// streaming routes. Headers rules run after the top-level ones; Cookies
+// replaces the top-level cookie policy
+type DataConfigProxyRoute struct {
+	Name         string                  `json:"name"`
+	Host         string                  `json:"host"`
+	Prefix       string                  `json:"prefix"`
+	StripPrefix  bool                    `json:"strip_prefix"`
+	AddPrefix    string                  `json:"add_prefix"`
+	Origins      []DataConfigProxyOrigin `json:"origins"`
+	Timeout      string                  `json:"timeout"`
+	WriteTimeout string                  `json:"write_timeout"`
+
+	ResponseHeaderTimeout string   `json:"response_header_timeout"`
+	AllowedMethods        []string `json:"allowed_methods"`
+	MaxRequestSize        int64    `json:"max_request_size"`
+	RequireAuth           *bool    `json:"require_auth"`
+
+	Headers DataConfigHeaderRules `json:"headers"`
+	Cookies *DataConfigCookies    `json:"cookies"`
+}
+
+// DataConfigHeaderRules rewrites the headers of origin requests and of their
+// responses, in order. AllowSensitive lists headers normally stripped
+// (Authorization, Cookie, X-Api-Key, Server, ...) that are passed through
+type DataConfigHeaderRules struct {
+	Request        []DataConfigHeaderRule `json:"request"`
+	Response       []DataConfigHeaderRule `json:"response"`
+	AllowSensitive []string               `json:"allow_sensitive"`
+}
+
+// DataConfigHeaderRule sets, adds, removes or renames (to To) the header
+// Name. Value may use ${client_ip}, ${request_id}, ${route}, ${host},
+// ${method}, ${path}, ${scheme}, ${tls_version}, ${tls_cipher} and
+// ${tls_server_name}. Setting Host on a request changes the Host sent to
+// the origin
+type DataConfigHeaderRule struct {
+	Action string `json:"action"`
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	To     string `json:"to"`
+}
+
+// DataConfigCookies controls cookies between clients and origins. Policy
+// "strip" removes the Cookie request header, "pass" forwards it and
+// "allowlist" forwards only the cookies named in Allow. Set-Cookie from the
+// origin is rewritten for the public host: a Domain not covering it is
+// replaced by Domain (removed when empty), Path is mapped back through the
+// route's prefix rewriting, Secure adds the Secure attribute and SameSite
+// ("Lax", "Strict" or "None") replaces the origin's
+type DataConfigCookies struct {
+	Policy   string   `json:"policy"`
+	Allow    []string `json:"allow"`
+	Domain   string   `json:"domain"`
+	Secure   bool     `json:"secure"`
+	SameSite string   `json:"same_site"`
+}
+
+// DataConfigProxyOrigin is one upstream of the proxy pool. Weight scales its
+// share of requests (1 when unset)
+type DataConfigProxyOrigin struct {
+	URL    string `json:"url"`
+	Weight int    `json:"weight"`
+}
+
+// DataConfigRetry controls retries of failed origin requests, at most
+// MaxRetries per request (2 when unset, 0 disables retries). Idempotent
+// requests (GET, HEAD, OPTIONS, PUT, DELETE or with an Idempotency-Key) are
+// retried on connection errors and RetryOn statuses; others only when the
+// connection to the origin could not be made. Bodies up to MaxBodyBytes are
+// buffered for replay, larger ones are never retried. Retries wait a random
+// backoff between 0 and BackoffBase doubled per attempt (at most BackoffMax)
+// and are capped by a budget of BudgetRatio of the requests plus
+// BudgetMinPerSecond, so retries cannot multiply the load of a failing origin
+type DataConfigRetry struct {
+	MaxRetries         *int    `json:"max_retries"`
+	RetryOn            []int   `json:"retry_on"`
+	MaxBodyBytes       int64   `json:"max_body_bytes"`
+	BackoffBase        string  `json:"backoff_base"`
+	BackoffMax         string  `json:"backoff_max"`
+	BudgetRatio        float64 `json:"budget_ratio"`
+	BudgetMinPerSecond int     `json:"budget_min_per_second"`
+}
+
+// MaxRetriesOrDefault returns MaxRetries, 2 when unset
+func (r *DataConfigRetry) MaxRetriesOrDefault() int {
+	if r.MaxRetries == nil {
+		return 2
+	}
+	return *r.MaxRetries
+}
+
+// DataConfigCircuitBreaker opens an origin's circuit once FailureRatio (0.5
+// when unset, 0 disables the breaker) of at least MinRequests requests within
+// Window failed. An open circuit takes no requests for OpenDuration, then
+// HalfOpenRequests trial requests decide whether it closes again or reopens
+type DataConfigCircuitBreaker struct {
+	FailureRatio     *float64 `json:"failure_ratio"`
+	MinRequests      int      `json:"min_requests"`
+	Window           string   `json:"window"`
+	OpenDuration     string   `json:"open_duration"`
+	HalfOpenRequests int      `json:"half_open_requests"`
+}
+
+// FailureRatioOrDefault returns FailureRatio, 0.5 when unset
+func (cb *DataConfigCircuitBreaker) FailureRatioOrDefault() float64 {
+	if cb.FailureRatio == nil {
+		return 0.5
+	}
+	return *cb.FailureRatio
+}
+
+// DataConfigUpgrade controls proxying of HTTP Upgrade requests such as
+// WebSockets. Only the listed Upgrade protocols are passed to the origin; an
+// upgraded connection is closed after IdleTimeout without traffic in either
+// direction. MaxConnections (1000 when unset) and MaxConnectionsPerIP (20
+// when unset) cap the number of open upgraded connections, 0 removes the cap
+type DataConfigUpgrade struct {
+	Protocols           []string `json:"protocols"`
+	IdleTimeout         string   `json:"idle_timeout"`
+	MaxConnections      *int     `json:"max_connections"`
+	MaxConnectionsPerIP *int     `json:"max_connections_per_ip"`
+}
+
+// MaxConnectionsOrDefault returns MaxConnections, 1000 when unset
+func (u *DataConfigUpgrade) MaxConnectionsOrDefault() int {
+	if u.MaxConnections == nil {
+		return 1000
+	}
+	return *u.MaxConnections
+}
+
+// MaxConnectionsPerIPOrDefault returns MaxConnectionsPerIP, 20 when unset
+func (u *DataConfigUpgrade) MaxConnectionsPerIPOrDefault() int {
+	if u.MaxConnectionsPerIP == nil {
+		return 20
+	}
+	return *u.MaxConnectionsPerIP
+}
+
+// DataConfigProxyCache controls the shared response cache (RFC 9111) for GET
+// and HEAD requests. Responses of up to MaxEntryBytes are kept in memory up to
+// MaxBytes; with DiskDir set every stored response is also written there, up
+// to DiskMaxBytes, and survives restarts. Concurrent misses for the same URL
+// wait up to LockTimeout for the first one instead of all reaching the
+// origin. POST or DELETE on PurgePath with the PurgeToken bearer token purges
+// entries (empty PurgeToken disables the endpoint)
+type DataConfigProxyCache struct {
+	Enabled       bool   `json:"enabled"`
+	MaxBytes      int64  `json:"max_bytes"`
+	MaxEntryBytes int64  `json:"max_entry_bytes"`
+	DiskDir       string `json:"disk_dir"`
+	DiskMaxBytes  int64  `json:"disk_max_bytes"`
+	LockTimeout   string `json:"lock_timeout"`
+	PurgePath     string `json:"purge_path"`
+	PurgeToken    string `json:"purge_token"`
+}
+
+// DataConfigHealthCheck controls upstream health. Active probes request Path
+// on every origin each Interval (empty Path disables them); an origin turns
+// unhealthy after UnhealthyThreshold failed probes and healthy again after
+// HealthyThreshold good ones. Passively, MaxFails (5 when unset) consecutive
+// 5xx responses or connection errors eject an origin for EjectDuration. A
+// MaxFails of 0 or an EjectDuration of "0" disables passive ejection
+type DataConfigHealthCheck struct {
+	Path               string `json:"path"`
+	Interval           string `json:"interval"`
+	Timeout            string `json:"timeout"`
+	ExpectedStatus     int    `json:"expected_status"`
+	HealthyThreshold   int    `json:"healthy_threshold"`
+	UnhealthyThreshold int    `json:"unhealthy_threshold"`
+	MaxFails           *int   `json:"max_fails"`
+	EjectDuration      string `json:"eject_duration"`
+}
+
+// MaxFailsOrDefault returns MaxFails, 5 when unset
+func (hc *DataConfigHealthCheck) MaxFailsOrDefault() int {
+	if hc.MaxFails == nil {
+		return 5
+	}
+	return *hc.MaxFails
+}
+
+// DataConfigLoadBalancing selects how requests are spread over the origins:
+// "round_robin", "least_connections", "random_two" (power of two random
+// choices) or "consistent_hash". Consistent hashing keys on the client IP, or
+// on HashHeader when set and present. Per-origin stats are logged every
+// StatsInterval ("0" disables)
+type DataConfigLoadBalancing struct {
+	Strategy      string `json:"strategy"`
+	HashHeader    string `json:"hash_header"`
+	StatsInterval string `json:"stats_interval"`
 }
 
 func DefaultConfigCsp() DataConfigCsp {
@@ -164,10 +614,89 @@ func ConfigDefault() DataConfig {
 		ListenAddr:       "127.0.0.1",
 		ListenPort:       "8080",
 		NoncePlaceholder: "NONCEHERE",
+		DocumentRoot:     "./public",
+		IndexFile:        "index.html",
 		Banner: []string{
 			`<!-- EZhttp ${BuildVersion} -->`,
 		},
-		Csp: DefaultConfigCsp(),
+		Csp:     DefaultConfigCsp(),
+		Headers: map[string]string{},
+		Sri: DataConfigSri{
+			Enabled:       false,
+			FailOnMissing: false,
+			WarnRemote:    nil, // WarnRemoteOrDefault
+		},
+		EarlyHints: false,
+		Maintenance: DataConfigMaintenance{
+			Enabled:      false,
+			SentinelFile: "",
+			Page:         "maintenance.html",
+			RetryAfter:   "5m",
+			BypassToken:  "",
+			BypassCookie: "ezhttp_maintenance_bypass",
+			BypassHeader: "X-Maintenance-Bypass",
+			AllowCIDRs:   []string{},
+		},
+		SignedURLs: []DataConfigSignedURL{},
+		Auth: DataConfigAuth{
+			Realm:           "ezhttp",
+			UsersFile:       "",
+			Tokens:          []string{},
+			Rules:           []DataConfigAuthRule{},
+			MaxAuthAttempts: 5,
+			BlockDuration:   "15m",
+		},
+		ContentCache: DataConfigContentCache{
+			Enabled:            false,
+			MaxBytes:           67108864, // 64MB
+			MaxFileSize:        1048576,  // 1MB
+			RevalidateInterval: "2s",
+		},
+		FileCache: DataConfigFileCache{
+			PositiveTTL:   "5m",
+			NegativeTTL:   "10s",
+			MaxEntries:    10000,
+			Watch:         nil, // WatchOrDefault
+			StatsInterval: "5m",
+		},
+		Manifest: DataConfigManifest{
+			Enabled:    false,
+			SignedFile: "",
+			PublicKey:  "",
+			Strict:     false,
+		},
+		ImageNegotiation: DataConfigImageNegotiation{
+			Prefixes: []string{},
+			Formats:  []string{"avif", "webp"},
+		},
+		ImageResize: DataConfigImageResize{
+			Prefixes:        []string{},
+			Widths:          []int{320, 480, 640, 960, 1280, 1920},
+			Qualities:       []int{60, 75, 85},
+			DefaultQuality:  75,
+			MaxConcurrent:   2,
+			MaxSourcePixels: 50000000, // 50 megapixels
+			CacheDir:        "./cache/images",
+			CacheMaxBytes:   536870912, // 512MB
+		},
+		Languages: DataConfigLanguages{
+			Available: []string{},
+			Default:   "",
+			Cookie:    "ezhttp_lang",
+			URLPrefix: nil, // URLPrefixOrDefault
+		},
+		IndexVariants: DataConfigIndexVariants{
+			Variants:     []DataConfigIndexVariant{},
+			Cookie:       "ezhttp_variant",
+			CookieMaxAge: "720h",
+			Secret:       "",
+			QueryParam:   "variant",
+			Header:       "X-Index-Variant",
+		},
+		DirectoryListing: DataConfigDirectoryListing{
+			Prefixes: []string{},
+			PageSize: 100,
+		},
 		RateLimit: DataConfigRateLimit{
 			Enabled:           true,
 			RequestsPerMinute: 60,
@@ -186,14 +715,183 @@ func ConfigDefault() DataConfig {
 			RelaxedOriginTLS:       false,
 			MaxIdleConns:           100,
 			IdleConnTimeout:        "90s",
+			DialTimeout:            "10s",
+			TLSHandshakeTimeout:    "10s",
+			ResponseHeaderTimeout:  "30s",
+			RequestTimeout:         "",
 			MaxRequestSize:         52428800, // 50MB
 			MaxAuthAttempts:        5,
 			BlockDuration:          "15m",
 			DebugMode:              false,
+			StreamWriteTimeout:     "30s",
+			Origins:                []DataConfigProxyOrigin{},
+			LoadBalancing: DataConfigLoadBalancing{
+				Strategy:      "round_robin",
+				HashHeader:    "",
+				StatsInterval: "5m",
+			},
+			HealthCheck: DataConfigHealthCheck{
+				Path:               "",
+				Interval:           "10s",
+				Timeout:            "2s",
+				ExpectedStatus:     200,
+				HealthyThreshold:   2,
+				UnhealthyThreshold: 3,
+				MaxFails:           nil, // MaxFailsOrDefault
+				EjectDuration:      "30s",
+			},
+			Routes: []DataConfigProxyRoute{},
+			Upgrade: DataConfigUpgrade{
+				Protocols:           []string{"websocket"},
+				IdleTimeout:         "5m",
+				MaxConnections:      nil, // MaxConnectionsOrDefault
+				MaxConnectionsPerIP: nil, // MaxConnectionsPerIPOrDefault
+			},
+			Retry: DataConfigRetry{
+				MaxRetries:         nil, // MaxRetriesOrDefault
+				RetryOn:            []int{502, 503, 504},
+				MaxBodyBytes:       1048576, // 1MB
+				BackoffBase:        "50ms",
+				BackoffMax:         "1s",
+				BudgetRatio:        0.2,
+				BudgetMinPerSecond: 10,
+			},
+			CircuitBreaker: DataConfigCircuitBreaker{
+				FailureRatio:     nil, // FailureRatioOrDefault
+				MinRequests:      20,
+				Window:           "10s",
+				OpenDuration:     "30s",
+				HalfOpenRequests: 3,
+			},
+			Cache: DataConfigProxyCache{
+				Enabled:       false,
+				MaxBytes:      67108864, // 64MB
+				MaxEntryBytes: 8388608,  // 8MB
+				DiskDir:       "",
+				DiskMaxBytes:  1073741824, // 1GB
+				LockTimeout:   "5s",
+				PurgePath:     "/_cache/purge",
+				PurgeToken:    "",
+			},
+			Cookies: DataConfigCookies{
+				Policy:   "strip",
+				Allow:    []string{},
+				Domain:   "",
+				Secure:   false,
+				SameSite: "",
+			},
 		},
 	}
 }
 
+// SiteConfigs returns the effective virtual host definitions. Without a
+// "sites" section the top-level settings form a single default site
+func (c *DataConfig) SiteConfigs() []DataConfigSite {
+	if len(c.Sites) == 0 {
+		return []DataConfigSite{c.inheritSite(DataConfigSite{Name: "default", Default: true})}
+	}
+
+	sites := make([]DataConfigSite, 0, len(c.Sites))
+	for i, site := range c.Sites {
+		if site.Name == "" {
+			site.Name = fmt.Sprintf("site%d", i)
+		}
+		sites = append(sites, c.inheritSite(site))
+	}
+	return sites
+}
+
+// inheritSection decodes the site's section over a copy of the top-level one,
+// so fields the site leaves out keep their top-level value. Going through JSON
+// rather than mergo lets a site set false or 0 explicitly
+func inheritSection[T any](site DataConfigSite, key string, top T, section *T) *T {
+	raw, found := site.sections[key]
+	if !found && section != nil {
+		// Built in code rather than decoded, use it as is
+		return section
+	}
+
+	merged := new(T)
+	data, err := json.Marshal(top)
+	if err == nil {
+		err = json.Unmarshal(data, merged)
+	}
+	if err == nil && found {
+		err = json.Unmarshal(raw, merged)
+	}
+	if err != nil {
+		logger.Error("Failed to merge site section", "site", site.Name, "section", key, "error", err)
+		if section != nil {
+			return section
+		}
+		return &top
+	}
+	return merged
+}
+
+// inheritSite fills unset site fields from the top-level configuration
+func (c *DataConfig) inheritSite(site DataConfigSite) DataConfigSite {
+	if site.DocumentRoot == "" {
+		site.DocumentRoot = c.DocumentRoot
+	}
+	if site.IndexFile == "" {
+		site.IndexFile = c.IndexFile
+	}
+	if site.NoncePlaceholder == "" {
+		site.NoncePlaceholder = c.NoncePlaceholder
+	}
+	if site.Banner == nil {
+		site.Banner = c.Banner
+	}
+	site.Sri = inheritSection(site, "sri", c.Sri, site.Sri)
+	if site.EarlyHints == nil {
+		earlyHints := c.EarlyHints
+		site.EarlyHints = &earlyHints
+	}
+	site.Maintenance = inheritSection(site, "maintenance", c.Maintenance, site.Maintenance)
+	if site.SignedURLs == nil {
+		site.SignedURLs = c.SignedURLs
+	}
+	site.Auth = inheritSection(site, "auth", c.Auth, site.Auth)
+	site.ContentCache = inheritSection(site, "content_cache", c.ContentCache, site.ContentCache)
+	site.FileCache = inheritSection(site, "file_cache", c.FileCache, site.FileCache)
+	site.Manifest = inheritSection(site, "manifest", c.Manifest, site.Manifest)
+	site.ImageNegotiation = inheritSection(site, "image_negotiation", c.ImageNegotiation, site.ImageNegotiation)
+	site.ImageResize = inheritSection(site, "image_resize", c.ImageResize, site.ImageResize)
+	site.Languages = inheritSection(site, "languages", c.Languages, site.Languages)
+	site.IndexVariants = inheritSection(site, "index_variants", c.IndexVariants, site.IndexVariants)
+	site.DirectoryListing = inheritSection(site, "directory_listing", c.DirectoryListing, site.DirectoryListing)
+	site.RateLimit = inheritSection(site, "rate_limit", c.RateLimit, site.RateLimit)
+
+	// Site CSP directives override the global ones individually
+	csp := site.Csp
+	if errMerge := mergo.Merge(&csp, c.Csp); errMerge != nil {
+		logger.Error("Failed to merge site CSP", "site", site.Name, "error", errMerge)
+	}
+	site.Csp = csp
+
+	// Site headers are layered on top of the global ones
+	headers := make(map[string]string, len(c.Headers)+len(site.Headers))
+	for k, v := range c.Headers {
+		headers[k] = v
+	}
+	for k, v := range site.Headers {
+		headers[k] = v
+	}
+	site.Headers = headers
+
+	// Client config layers: global, site, then environment
+	clientConfig := make(map[string]any)
+	for _, layer := range []map[string]any{c.ClientConfig, site.ClientConfig, c.clientConfigEnv} {
+		for k, v := range layer {
+			clientConfig[k] = v
+		}
+	}
+	site.ClientConfig = clientConfig
+
+	return site
+}
+
 func ConfigReadFromFile(filename string) DataConfig {
 	filebytes, err := os.ReadFile(filename)
 	if err != nil {
@@ -273,6 +971,22 @@ func ConfigLoad() DataConfig {
 		c.Proxy.DebugMode = true
 	}
 
+	// Client config environment overrides
+	// EZHTTP_PUBLIC_API_BASE_URL=https://api.example.com => "api_base_url"
+	const clientConfigEnvPrefix = "EZHTTP_PUBLIC_"
+	for _, env := range os.Environ() {
+		name, value, found := strings.Cut(env, "=")
+		if !found || !strings.HasPrefix(name, clientConfigEnvPrefix) || len(name) == len(clientConfigEnvPrefix) {
+			continue
+		}
+		key := strings.ToLower(strings.TrimPrefix(name, clientConfigEnvPrefix))
+		if c.clientConfigEnv == nil {
+			c.clientConfigEnv = make(map[string]any)
+		}
+		logger.Info("Environment override for client config", "key", key)
+		c.clientConfigEnv[key] = value
+	}
+
 	// Validate configuration
 	if err := ValidateConfig(&c); err != nil {
 		logger.Fatal("Config validation failed", "error", err)
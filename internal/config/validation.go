@@ -1,14 +1,23 @@
 package config
 
 import (
+	"encoding/json"
 	"fmt"
 	"net"
+	"net/url"
 	"os"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
 )
 
+// Simplified BCP 47 tag, e.g. "de" or "pt-BR"
+var languageTagPattern = regexp.MustCompile(`^[A-Za-z]{2,8}(-[A-Za-z0-9]{1,8})*$`)
+
+// Index variant names end up in cookies and headers
+var variantNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
 // Validates all configuration values
 func ValidateConfig(c *DataConfig) error {
 	// Validate listen address
@@ -32,18 +41,13 @@ func ValidateConfig(c *DataConfig) error {
 	}
 
 	// Validate rate limit settings
-	if c.RateLimit.Enabled {
-		if c.RateLimit.RequestsPerMinute <= 0 {
-			return fmt.Errorf("rate limit requests per minute must be positive")
-		}
-		if c.RateLimit.BurstSize <= 0 {
-			return fmt.Errorf("rate limit burst size must be positive")
-		}
-		if c.RateLimit.CleanupInterval != "" {
-			if _, err := time.ParseDuration(c.RateLimit.CleanupInterval); err != nil {
-				return fmt.Errorf("invalid cleanup interval: %w", err)
-			}
-		}
+	if err := validateRateLimit(&c.RateLimit); err != nil {
+		return err
+	}
+
+	// Validate virtual hosts
+	if err := validateSites(c); err != nil {
+		return fmt.Errorf("invalid sites configuration: %w", err)
 	}
 
 	// Validate proxy settings
@@ -51,6 +55,10 @@ func ValidateConfig(c *DataConfig) error {
 		return fmt.Errorf("proxy auth token must be at least 16 characters long")
 	}
 
+	if err := validateProxyOrigins(&c.Proxy); err != nil {
+		return fmt.Errorf("invalid proxy configuration: %w", err)
+	}
+
 	// Validate TLS settings
 	if c.TLS.CertFile != "" || c.TLS.KeyFile != "" {
 		// If one is set, both must be set
@@ -70,6 +78,663 @@ func ValidateConfig(c *DataConfig) error {
 	return nil
 }
 
+// Validates rate limit settings
+func validateRateLimit(rl *DataConfigRateLimit) error {
+	if !rl.Enabled {
+		return nil
+	}
+	if rl.RequestsPerMinute <= 0 {
+		return fmt.Errorf("rate limit requests per minute must be positive")
+	}
+	if rl.BurstSize <= 0 {
+		return fmt.Errorf("rate limit burst size must be positive")
+	}
+	if rl.CleanupInterval != "" {
+		if _, err := time.ParseDuration(rl.CleanupInterval); err != nil {
+			return fmt.Errorf("invalid cleanup interval: %w", err)
+		}
+	}
+	return nil
+}
+
+// Validates the effective site list
+func validateSites(c *DataConfig) error {
+	seenNames := make(map[string]bool)
+	seenHosts := make(map[string]string)
+	defaults := 0
+
+	for _, site := range c.SiteConfigs() {
+		if seenNames[site.Name] {
+			return fmt.Errorf("duplicate site name: %s", site.Name)
+		}
+		seenNames[site.Name] = true
+
+		if site.Default {
+			defaults++
+		}
+		if len(site.Hosts) == 0 && !site.Default {
+			return fmt.Errorf("site %s must list at least one host or be the default", site.Name)
+		}
+
+		for _, host := range site.Hosts {
+			if err := validateHostPattern(host); err != nil {
+				return fmt.Errorf("site %s: %w", site.Name, err)
+			}
+			key := strings.ToLower(host)
+			if other, exists := seenHosts[key]; exists {
+				return fmt.Errorf("host %s is claimed by both %s and %s", host, other, site.Name)
+			}
+			seenHosts[key] = site.Name
+		}
+
+		if site.DocumentRoot == "" {
+			return fmt.Errorf("site %s: document root cannot be empty", site.Name)
+		}
+		if site.IndexFile == "" || strings.ContainsAny(site.IndexFile, "/\\") {
+			return fmt.Errorf("site %s: index file must be a plain file name", site.Name)
+		}
+		if err := validateNoncePlaceholder(site.NoncePlaceholder); err != nil {
+			return fmt.Errorf("site %s: invalid nonce placeholder: %w", site.Name, err)
+		}
+		if err := validateCSP(&site.Csp); err != nil {
+			return fmt.Errorf("site %s: invalid CSP configuration: %w", site.Name, err)
+		}
+		if err := validateRateLimit(site.RateLimit); err != nil {
+			return fmt.Errorf("site %s: %w", site.Name, err)
+		}
+		if err := validateMaintenance(site.Maintenance); err != nil {
+			return fmt.Errorf("site %s: invalid maintenance configuration: %w", site.Name, err)
+		}
+		if err := validateAuth(site.Auth); err != nil {
+			return fmt.Errorf("site %s: invalid auth configuration: %w", site.Name, err)
+		}
+		if err := validateContentCache(site.ContentCache); err != nil {
+			return fmt.Errorf("site %s: invalid content cache configuration: %w", site.Name, err)
+		}
+		if err := validateFileCache(site.FileCache); err != nil {
+			return fmt.Errorf("site %s: invalid file cache configuration: %w", site.Name, err)
+		}
+		if site.Manifest.Enabled && site.Manifest.SignedFile != "" {
+			if site.Manifest.PublicKey == "" {
+				return fmt.Errorf("site %s: signed manifest requires a public key", site.Name)
+			}
+			if _, err := os.Stat(site.Manifest.SignedFile); err != nil {
+				return fmt.Errorf("site %s: signed manifest not found: %s", site.Name, site.Manifest.SignedFile)
+			}
+		}
+		for _, format := range site.ImageNegotiation.Formats {
+			if format != "avif" && format != "webp" {
+				return fmt.Errorf("site %s: unsupported image negotiation format: %s", site.Name, format)
+			}
+		}
+		for _, prefix := range site.ImageNegotiation.Prefixes {
+			if !strings.HasPrefix(prefix, "/") {
+				return fmt.Errorf("site %s: image negotiation prefix must be an absolute path: %s", site.Name, prefix)
+			}
+		}
+		if err := validateImageResize(site.ImageResize); err != nil {
+			return fmt.Errorf("site %s: invalid image resize configuration: %w", site.Name, err)
+		}
+		if len(site.ImageResize.Prefixes) > 0 && (strings.ContainsAny(site.Name, "/\\") || strings.HasPrefix(site.Name, ".")) {
+			// The name is used as the site's cache directory
+			return fmt.Errorf("site %s: name must be a plain directory name when image resizing is enabled", site.Name)
+		}
+		if err := validateLanguages(site.Languages); err != nil {
+			return fmt.Errorf("site %s: invalid languages configuration: %w", site.Name, err)
+		}
+		if err := validateIndexVariants(site.IndexVariants); err != nil {
+			return fmt.Errorf("site %s: invalid index variants configuration: %w", site.Name, err)
+		}
+		for _, prefix := range site.DirectoryListing.Prefixes {
+			if !strings.HasPrefix(prefix, "/") || !strings.HasSuffix(prefix, "/") || strings.Contains(prefix, "..") {
+				return fmt.Errorf("site %s: directory listing prefix must be an absolute path ending in /: %s", site.Name, prefix)
+			}
+		}
+		if len(site.DirectoryListing.Prefixes) > 0 && site.DirectoryListing.PageSize <= 0 {
+			return fmt.Errorf("site %s: directory listing page size must be positive", site.Name)
+		}
+		for _, signed := range site.SignedURLs {
+			if err := validateSignedURL(&signed); err != nil {
+				return fmt.Errorf("site %s: invalid signed URL configuration: %w", site.Name, err)
+			}
+		}
+		if _, err := json.Marshal(site.ClientConfig); err != nil {
+			return fmt.Errorf("site %s: invalid client config: %w", site.Name, err)
+		}
+		for name := range site.Headers {
+			if name == "" || strings.ContainsAny(name, " :\r\n") {
+				return fmt.Errorf("site %s: invalid header name: %q", site.Name, name)
+			}
+		}
+	}
+
+	if defaults > 1 {
+		return fmt.Errorf("only one site can be the default")
+	}
+
+	return nil
+}
+
+// Validates maintenance mode settings
+func validateMaintenance(m *DataConfigMaintenance) error {
+	if m.RetryAfter != "" {
+		if _, err := time.ParseDuration(m.RetryAfter); err != nil {
+			return fmt.Errorf("invalid retry after: %w", err)
+		}
+	}
+	if m.BypassToken != "" && len(m.BypassToken) < 16 {
+		return fmt.Errorf("bypass token must be at least 16 characters long")
+	}
+	if m.Page != "" && strings.ContainsAny(m.Page, "/\\") {
+		return fmt.Errorf("page must be a plain file name")
+	}
+	for _, cidr := range m.AllowCIDRs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("invalid CIDR: %s", cidr)
+		}
+	}
+	return nil
+}
+
+// Validates a signed URL prefix rule
+func validateSignedURL(s *DataConfigSignedURL) error {
+	if !strings.HasPrefix(s.Prefix, "/") || strings.Contains(s.Prefix, "..") {
+		return fmt.Errorf("prefix must be an absolute path: %s", s.Prefix)
+	}
+	if len(s.Secret) < 32 {
+		return fmt.Errorf("secret for %s must be at least 32 characters long", s.Prefix)
+	}
+	return nil
+}
+
+// Validates static server authentication settings
+func validateAuth(a *DataConfigAuth) error {
+	if len(a.Rules) == 0 {
+		return nil
+	}
+	if a.UsersFile == "" && len(a.Tokens) == 0 {
+		return fmt.Errorf("auth rules require a users file or tokens")
+	}
+	if a.UsersFile != "" {
+		if _, err := os.Stat(a.UsersFile); err != nil {
+			return fmt.Errorf("users file not found: %s", a.UsersFile)
+		}
+	}
+	for _, token := range a.Tokens {
+		if len(token) < 16 {
+			return fmt.Errorf("auth tokens must be at least 16 characters long")
+		}
+	}
+	if strings.ContainsAny(a.Realm, "\"\\\r\n") {
+		return fmt.Errorf("realm contains invalid characters")
+	}
+	if a.MaxAuthAttempts <= 0 {
+		return fmt.Errorf("max auth attempts must be positive")
+	}
+	if a.BlockDuration != "" {
+		if _, err := time.ParseDuration(a.BlockDuration); err != nil {
+			return fmt.Errorf("invalid block duration: %w", err)
+		}
+	}
+	for _, rule := range a.Rules {
+		if !strings.HasPrefix(rule.Prefix, "/") {
+			return fmt.Errorf("rule prefix must be an absolute path: %s", rule.Prefix)
+		}
+	}
+	return nil
+}
+
+// Validates in-memory content cache settings
+func validateContentCache(cc *DataConfigContentCache) error {
+	if !cc.Enabled {
+		return nil
+	}
+	if cc.MaxBytes <= 0 || cc.MaxFileSize <= 0 {
+		return fmt.Errorf("max bytes and max file size must be positive")
+	}
+	if cc.MaxFileSize > cc.MaxBytes {
+		return fmt.Errorf("max file size cannot exceed max bytes")
+	}
+	if cc.RevalidateInterval != "" {
+		if _, err := time.ParseDuration(cc.RevalidateInterval); err != nil {
+			return fmt.Errorf("invalid revalidate interval: %w", err)
+		}
+	}
+	return nil
+}
+
+// Validates file existence cache settings
+func validateFileCache(fc *DataConfigFileCache) error {
+	for name, value := range map[string]string{"positive ttl": fc.PositiveTTL, "negative ttl": fc.NegativeTTL, "stats interval": fc.StatsInterval} {
+		if value == "" {
+			continue
+		}
+		if d, err := time.ParseDuration(value); err != nil || d < 0 {
+			return fmt.Errorf("invalid %s: %s", name, value)
+		}
+	}
+	if fc.MaxEntries <= 0 {
+		return fmt.Errorf("max entries must be positive")
+	}
+	return nil
+}
+
+// Validates on-the-fly image resizing settings
+func validateImageResize(ir *DataConfigImageResize) error {
+	if len(ir.Prefixes) == 0 {
+		return nil
+	}
+	for _, prefix := range ir.Prefixes {
+		if !strings.HasPrefix(prefix, "/") {
+			return fmt.Errorf("prefix must be an absolute path: %s", prefix)
+		}
+	}
+	if len(ir.Widths) == 0 {
+		return fmt.Errorf("at least one width is required")
+	}
+	for _, width := range ir.Widths {
+		if width <= 0 || width > 8192 {
+			return fmt.Errorf("width must be between 1 and 8192: %d", width)
+		}
+	}
+	for _, quality := range ir.Qualities {
+		if quality < 1 || quality > 100 {
+			return fmt.Errorf("quality must be between 1 and 100: %d", quality)
+		}
+	}
+	if ir.DefaultQuality < 1 || ir.DefaultQuality > 100 {
+		return fmt.Errorf("default quality must be between 1 and 100")
+	}
+	if ir.MaxConcurrent <= 0 {
+		return fmt.Errorf("max concurrent must be positive")
+	}
+	if ir.MaxSourcePixels <= 0 {
+		return fmt.Errorf("max source pixels must be positive")
+	}
+	if ir.CacheDir == "" {
+		return fmt.Errorf("cache dir is required")
+	}
+	if ir.CacheMaxBytes <= 0 {
+		return fmt.Errorf("cache max bytes must be positive")
+	}
+	return nil
+}
+
+// Validates localized index settings
+func validateLanguages(l *DataConfigLanguages) error {
+	if len(l.Available) == 0 {
+		return nil
+	}
+	defaultFound := l.Default == ""
+	for _, lang := range l.Available {
+		if !languageTagPattern.MatchString(lang) {
+			return fmt.Errorf("invalid language tag: %s", lang)
+		}
+		if strings.EqualFold(lang, l.Default) {
+			defaultFound = true
+		}
+	}
+	if !defaultFound {
+		return fmt.Errorf("default language %s is not available", l.Default)
+	}
+	if l.Cookie != "" && strings.ContainsAny(l.Cookie, " ;=,\t\r\n") {
+		return fmt.Errorf("invalid cookie name: %s", l.Cookie)
+	}
+	return nil
+}
+
+// Validates A/B index variant settings
+func validateIndexVariants(iv *DataConfigIndexVariants) error {
+	if len(iv.Variants) == 0 {
+		return nil
+	}
+	names := make(map[string]bool)
+	totalWeight := 0
+	for _, variant := range iv.Variants {
+		if !variantNamePattern.MatchString(variant.Name) {
+			return fmt.Errorf("invalid variant name: %q", variant.Name)
+		}
+		if names[variant.Name] {
+			return fmt.Errorf("duplicate variant name: %s", variant.Name)
+		}
+		names[variant.Name] = true
+		if variant.IndexFile != "" && strings.ContainsAny(variant.IndexFile, "/\\") {
+			return fmt.Errorf("variant %s: index file must be a plain file name", variant.Name)
+		}
+		if variant.Weight < 0 {
+			return fmt.Errorf("variant %s: weight cannot be negative", variant.Name)
+		}
+		totalWeight += variant.Weight
+	}
+	if totalWeight == 0 {
+		return fmt.Errorf("at least one variant needs a positive weight")
+	}
+	if iv.Cookie == "" || strings.ContainsAny(iv.Cookie, " ;=,\t\r\n") {
+		return fmt.Errorf("invalid cookie name: %q", iv.Cookie)
+	}
+	if _, err := time.ParseDuration(iv.CookieMaxAge); err != nil {
+		return fmt.Errorf("invalid cookie max age: %w", err)
+	}
+	if iv.Secret != "" && len(iv.Secret) < 32 {
+		return fmt.Errorf("secret must be at least 32 characters long")
+	}
+	if iv.Header != "" && strings.ContainsAny(iv.Header, " :\r\n") {
+		return fmt.Errorf("invalid header name: %q", iv.Header)
+	}
+	return nil
+}
+
+// Validates the proxy upstream pool and load balancing settings
+func validateProxyOrigins(p *DataConfigProxy) error {
+	for _, origin := range p.Origins {
+		originURL, err := url.Parse(origin.URL)
+		if err != nil || (originURL.Scheme != "http" && originURL.Scheme != "https") || originURL.Host == "" {
+			return fmt.Errorf("invalid origin URL: %s", origin.URL)
+		}
+		if origin.Weight < 0 {
+			return fmt.Errorf("origin %s: weight cannot be negative", origin.URL)
+		}
+	}
+	switch p.LoadBalancing.Strategy {
+	case "", "round_robin", "least_connections", "random_two", "consistent_hash":
+	default:
+		return fmt.Errorf("unknown load balancing strategy: %s", p.LoadBalancing.Strategy)
+	}
+	for i, route := range p.Routes {
+		if err := validateProxyRoute(p, &route); err != nil {
+			return fmt.Errorf("route %d (%s): %w", i, route.Name, err)
+		}
+	}
+	hc := &p.HealthCheck
+	for name, value := range map[string]string{"health check interval": hc.Interval, "health check timeout": hc.Timeout, "eject duration": hc.EjectDuration} {
+		if value == "" {
+			continue
+		}
+		if d, err := time.ParseDuration(value); err != nil || d < 0 {
+			return fmt.Errorf("invalid %s: %s", name, value)
+		}
+	}
+	if hc.Path != "" {
+		if !strings.HasPrefix(hc.Path, "/") {
+			return fmt.Errorf("health check path must be absolute: %s", hc.Path)
+		}
+		if hc.ExpectedStatus < 100 || hc.ExpectedStatus > 599 {
+			return fmt.Errorf("invalid health check expected status: %d", hc.ExpectedStatus)
+		}
+		if hc.HealthyThreshold <= 0 || hc.UnhealthyThreshold <= 0 {
+			return fmt.Errorf("health check thresholds must be positive")
+		}
+	}
+	if hc.MaxFailsOrDefault() < 0 {
+		return fmt.Errorf("max fails cannot be negative")
+	}
+	if p.LoadBalancing.StatsInterval != "" {
+		if _, err := time.ParseDuration(p.LoadBalancing.StatsInterval); err != nil {
+			return fmt.Errorf("invalid stats interval: %w", err)
+		}
+	}
+	for name, value := range map[string]string{
+		"dial timeout":            p.DialTimeout,
+		"TLS handshake timeout":   p.TLSHandshakeTimeout,
+		"response header timeout": p.ResponseHeaderTimeout,
+		"request timeout":         p.RequestTimeout,
+		"stream write timeout":    p.StreamWriteTimeout,
+	} {
+		if value == "" {
+			continue
+		}
+		if d, err := time.ParseDuration(value); err != nil || d <= 0 {
+			return fmt.Errorf("invalid %s: %s", name, value)
+		}
+	}
+	if err := validateProxyRetry(&p.Retry); err != nil {
+		return err
+	}
+	if err := validateCircuitBreaker(&p.CircuitBreaker); err != nil {
+		return err
+	}
+	if err := validateProxyUpgrade(&p.Upgrade); err != nil {
+		return err
+	}
+	if err := validateProxyCache(&p.Cache); err != nil {
+		return err
+	}
+	if err := validateCookies(&p.Cookies); err != nil {
+		return err
+	}
+	return validateHeaderRules(&p.Headers)
+}
+
+// Validates the proxy retry settings
+func validateProxyRetry(r *DataConfigRetry) error {
+	if r.MaxRetriesOrDefault() < 0 {
+		return fmt.Errorf("max retries cannot be negative")
+	}
+	for _, status := range r.RetryOn {
+		if status < 500 || status > 599 {
+			return fmt.Errorf("retry on status must be a 5xx status: %d", status)
+		}
+	}
+	if r.MaxBodyBytes < 0 {
+		return fmt.Errorf("retry max body bytes cannot be negative")
+	}
+	for name, value := range map[string]string{"retry backoff base": r.BackoffBase, "retry backoff max": r.BackoffMax} {
+		if value == "" {
+			continue
+		}
+		if d, err := time.ParseDuration(value); err != nil || d < 0 {
+			return fmt.Errorf("invalid %s: %s", name, value)
+		}
+	}
+	if r.BudgetRatio < 0 || r.BudgetMinPerSecond < 0 {
+		return fmt.Errorf("retry budget cannot be negative")
+	}
+	return nil
+}
+
+// Validates the per-origin circuit breaker settings
+func validateCircuitBreaker(cb *DataConfigCircuitBreaker) error {
+	failureRatio := cb.FailureRatioOrDefault()
+	if failureRatio < 0 || failureRatio > 1 {
+		return fmt.Errorf("circuit breaker failure ratio must be between 0 and 1: %v", failureRatio)
+	}
+	if failureRatio == 0 {
+		return nil
+	}
+	for name, value := range map[string]string{"circuit breaker window": cb.Window, "circuit breaker open duration": cb.OpenDuration} {
+		if d, err := time.ParseDuration(value); err != nil || d <= 0 {
+			return fmt.Errorf("invalid %s: %s", name, value)
+		}
+	}
+	if cb.MinRequests <= 0 || cb.HalfOpenRequests <= 0 {
+		return fmt.Errorf("circuit breaker request counts must be positive")
+	}
+	return nil
+}
+
+// Validates the HTTP Upgrade (WebSocket) proxy settings
+func validateProxyUpgrade(u *DataConfigUpgrade) error {
+	for _, protocol := range u.Protocols {
+		if protocol == "" || strings.ContainsAny(protocol, " ,\r\n") {
+			return fmt.Errorf("invalid upgrade protocol: %q", protocol)
+		}
+	}
+	if u.IdleTimeout != "" {
+		if d, err := time.ParseDuration(u.IdleTimeout); err != nil || d <= 0 {
+			return fmt.Errorf("invalid upgrade idle timeout: %s", u.IdleTimeout)
+		}
+	}
+	if u.MaxConnectionsOrDefault() < 0 || u.MaxConnectionsPerIPOrDefault() < 0 {
+		return fmt.Errorf("upgrade connection limits cannot be negative")
+	}
+	return nil
+}
+
+// Validates the proxy response cache settings
+func validateProxyCache(c *DataConfigProxyCache) error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.MaxBytes <= 0 || c.MaxEntryBytes <= 0 {
+		return fmt.Errorf("cache max bytes and max entry bytes must be positive")
+	}
+	if c.MaxEntryBytes > c.MaxBytes {
+		return fmt.Errorf("cache max entry bytes cannot exceed max bytes")
+	}
+	if c.DiskDir != "" && c.DiskMaxBytes < c.MaxEntryBytes {
+		return fmt.Errorf("cache disk max bytes cannot be less than max entry bytes")
+	}
+	if c.LockTimeout != "" {
+		if d, err := time.ParseDuration(c.LockTimeout); err != nil || d < 0 {
+			return fmt.Errorf("invalid cache lock timeout: %s", c.LockTimeout)
+		}
+	}
+	if c.PurgeToken != "" {
+		if !strings.HasPrefix(c.PurgePath, "/") {
+			return fmt.Errorf("cache purge path must be an absolute path: %q", c.PurgePath)
+		}
+		if len(c.PurgeToken) < 16 {
+			return fmt.Errorf("cache purge token must be at least 16 characters")
+		}
+	}
+	return nil
+}
+
+// Validates one proxy route
+func validateProxyRoute(p *DataConfigProxy, route *DataConfigProxyRoute) error {
+	if !strings.HasPrefix(route.Prefix, "/") {
+		return fmt.Errorf("prefix must be an absolute path: %q", route.Prefix)
+	}
+	if route.AddPrefix != "" && !strings.HasPrefix(route.AddPrefix, "/") {
+		return fmt.Errorf("add prefix must be an absolute path: %q", route.AddPrefix)
+	}
+	if route.Host != "" {
+		if err := validateHostPattern(route.Host); err != nil {
+			return err
+		}
+	}
+	if len(route.Origins) == 0 && p.OriginBaseURL == "" && len(p.Origins) == 0 {
+		return fmt.Errorf("route needs origins when there is no top-level origin")
+	}
+	for _, origin := range route.Origins {
+		originURL, err := url.Parse(origin.URL)
+		if err != nil || (originURL.Scheme != "http" && originURL.Scheme != "https") || originURL.Host == "" {
+			return fmt.Errorf("invalid origin URL: %s", origin.URL)
+		}
+		if origin.Weight < 0 {
+			return fmt.Errorf("origin %s: weight cannot be negative", origin.URL)
+		}
+	}
+	if route.Timeout != "" {
+		if d, err := time.ParseDuration(route.Timeout); err != nil || d <= 0 {
+			return fmt.Errorf("invalid timeout: %s", route.Timeout)
+		}
+	}
+	for name, value := range map[string]string{"write timeout": route.WriteTimeout, "response header timeout": route.ResponseHeaderTimeout} {
+		if value == "" {
+			continue
+		}
+		if d, err := time.ParseDuration(value); err != nil || d <= 0 {
+			return fmt.Errorf("invalid %s: %s", name, value)
+		}
+	}
+	for _, method := range route.AllowedMethods {
+		if method == "" || strings.ToUpper(method) != method {
+			return fmt.Errorf("invalid method: %q", method)
+		}
+	}
+	if route.MaxRequestSize < 0 {
+		return fmt.Errorf("max request size cannot be negative")
+	}
+	if route.RequireAuth != nil && *route.RequireAuth && p.AuthToken == "" {
+		return fmt.Errorf("route requires auth but no proxy auth token is configured")
+	}
+	if route.Cookies != nil {
+		if err := validateCookies(route.Cookies); err != nil {
+			return err
+		}
+	}
+	return validateHeaderRules(&route.Headers)
+}
+
+// Validates proxy header rewrite rules
+func validateHeaderRules(hr *DataConfigHeaderRules) error {
+	invalidName := func(name string) bool {
+		return name == "" || strings.ContainsAny(name, " :\r\n")
+	}
+	for _, rules := range [][]DataConfigHeaderRule{hr.Request, hr.Response} {
+		for _, rule := range rules {
+			if invalidName(rule.Name) {
+				return fmt.Errorf("invalid header name: %q", rule.Name)
+			}
+			switch strings.ToLower(rule.Action) {
+			case "set", "add":
+				if strings.ContainsAny(rule.Value, "\r\n") {
+					return fmt.Errorf("header %s: value cannot contain line breaks", rule.Name)
+				}
+			case "remove":
+			case "rename":
+				if invalidName(rule.To) {
+					return fmt.Errorf("header %s: invalid rename target: %q", rule.Name, rule.To)
+				}
+			default:
+				return fmt.Errorf("header %s: unknown action: %q", rule.Name, rule.Action)
+			}
+		}
+	}
+	for _, name := range hr.AllowSensitive {
+		if invalidName(name) {
+			return fmt.Errorf("invalid allowed sensitive header: %q", name)
+		}
+		if strings.EqualFold(name, "Cookie") {
+			return fmt.Errorf("cookies are passed by the cookie policy, not allow sensitive")
+		}
+	}
+	return nil
+}
+
+// Validates a proxy cookie policy
+func validateCookies(c *DataConfigCookies) error {
+	switch strings.ToLower(c.Policy) {
+	case "", "strip", "pass":
+	case "allowlist":
+		if len(c.Allow) == 0 {
+			return fmt.Errorf("cookie allowlist policy requires allowed cookie names")
+		}
+	default:
+		return fmt.Errorf("unknown cookie policy: %q", c.Policy)
+	}
+	for _, name := range c.Allow {
+		if name == "" || strings.ContainsAny(name, " =;,\t\r\n") {
+			return fmt.Errorf("invalid cookie name: %q", name)
+		}
+	}
+	if strings.ContainsAny(c.Domain, " ;,\t\r\n") {
+		return fmt.Errorf("invalid cookie domain: %q", c.Domain)
+	}
+	switch strings.ToLower(c.SameSite) {
+	case "", "lax", "strict", "none":
+	default:
+		return fmt.Errorf("cookie same site must be Lax, Strict or None: %q", c.SameSite)
+	}
+	return nil
+}
+
+// Validates a virtual host pattern ("example.com" or "*.example.com")
+func validateHostPattern(host string) error {
+	if host == "" {
+		return fmt.Errorf("host cannot be empty")
+	}
+	name := strings.TrimPrefix(host, "*.")
+	if name == "" || strings.Contains(name, "*") {
+		return fmt.Errorf("wildcard is only allowed as the leftmost label: %s", host)
+	}
+	if strings.ContainsAny(name, " /:") {
+		return fmt.Errorf("host must not contain a port or path: %s", host)
+	}
+	return nil
+}
+
 // Validates the listen address format
 func validateListenAddr(addr string) error {
 	if addr == "" {
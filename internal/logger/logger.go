@@ -2,6 +2,7 @@ package logger
 
 import (
 	"context"
+	"io"
 	"log/slog"
 	"os"
 )
@@ -9,6 +10,11 @@ import (
 var DefaultLogger *slog.Logger
 
 func init() {
+	SetOutput(os.Stdout)
+}
+
+// SetOutput replaces the default logger with one writing to w
+func SetOutput(w io.Writer) {
 	// Set log level based on environment variable
 	level := slog.LevelInfo
 	if os.Getenv("LOG_LEVEL") == "debug" {
@@ -35,7 +41,7 @@ func init() {
 		},
 	}
 
-	handler := slog.NewJSONHandler(os.Stdout, opts)
+	handler := slog.NewJSONHandler(w, opts)
 	DefaultLogger = slog.New(handler)
 	slog.SetDefault(DefaultLogger)
 }
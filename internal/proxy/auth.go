@@ -19,6 +19,12 @@ func AuthMiddleware(authToken string, limiter *ProxyLimiter) func(http.Handler)
 				return
 			}
 
+			// Routes can opt out of authentication
+			if route := RouteFromContext(r.Context()); route != nil && !route.RequiresAuth(true) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
 			ip := ratelimit.ExtractIP(r.RemoteAddr)
 
 			// Check if IP is blocked
@@ -0,0 +1,192 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ezhttp/ezhttp/internal/config"
+	"github.com/ezhttp/ezhttp/internal/logger"
+)
+
+// Circuit breaker states
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// circuitBreaker stops sending requests to an origin whose failure ratio
+// is too high. A nil breaker is always closed
+type circuitBreaker struct {
+	origin           string
+	failureRatio     float64
+	minRequests      int
+	window           time.Duration
+	openDuration     time.Duration
+	halfOpenRequests int
+
+	mu          sync.Mutex
+	state       breakerState
+	windowStart time.Time
+	requests    int
+	failures    int
+	openUntil   time.Time
+
+	// Half-open trials; trialsUntil frees the slots of trials that never
+	// reported an outcome
+	trials      int
+	successes   int
+	trialsUntil time.Time
+}
+
+// newCircuitBreaker creates the breaker of an origin. Returns nil when the
+// breaker is disabled
+func newCircuitBreaker(origin string, cfg *config.DataConfigCircuitBreaker) *circuitBreaker {
+	failureRatio := cfg.FailureRatioOrDefault()
+	if failureRatio <= 0 {
+		return nil
+	}
+	window, err := time.ParseDuration(cfg.Window)
+	if err != nil || window <= 0 {
+		window = 10 * time.Second
+	}
+	openDuration, err := time.ParseDuration(cfg.OpenDuration)
+	if err != nil || openDuration <= 0 {
+		openDuration = 30 * time.Second
+	}
+	return &circuitBreaker{
+		origin:           origin,
+		failureRatio:     failureRatio,
+		minRequests:      max(cfg.MinRequests, 1),
+		window:           window,
+		openDuration:     openDuration,
+		halfOpenRequests: max(cfg.HalfOpenRequests, 1),
+		windowStart:      time.Now(),
+	}
+}
+
+// ready reports whether the breaker could let a request through, without
+// taking a half-open trial slot
+func (b *circuitBreaker) ready() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	switch b.state {
+	case breakerOpen:
+		return !now.Before(b.openUntil)
+	case breakerHalfOpen:
+		return b.trials < b.halfOpenRequests || now.After(b.trialsUntil)
+	default:
+		return true
+	}
+}
+
+// allow reports whether a request may be sent, taking a trial slot when
+// the breaker is half-open
+func (b *circuitBreaker) allow() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	if b.state == breakerOpen {
+		if now.Before(b.openUntil) {
+			return false
+		}
+		b.state = breakerHalfOpen
+		b.trials = 0
+		b.successes = 0
+		logger.Info("Circuit breaker half-open", "origin", b.origin)
+	}
+	if b.state == breakerHalfOpen {
+		if now.After(b.trialsUntil) {
+			b.trials = 0
+		}
+		if b.trials >= b.halfOpenRequests {
+			return false
+		}
+		b.trials++
+		b.trialsUntil = now.Add(b.openDuration)
+	}
+	return true
+}
+
+// record counts the outcome of a request and moves between states
+func (b *circuitBreaker) record(success bool) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	switch b.state {
+	case breakerClosed:
+		if now.Sub(b.windowStart) >= b.window {
+			b.windowStart = now
+			b.requests = 0
+			b.failures = 0
+		}
+		b.requests++
+		if !success {
+			b.failures++
+		}
+		if b.requests >= b.minRequests && float64(b.failures) >= b.failureRatio*float64(b.requests) {
+			logger.Warn("Circuit breaker opened",
+				"origin", b.origin,
+				"failures", b.failures,
+				"requests", b.requests,
+				"duration", b.openDuration.String())
+			b.open(now)
+		}
+	case breakerHalfOpen:
+		if !success {
+			logger.Warn("Circuit breaker reopened", "origin", b.origin, "duration", b.openDuration.String())
+			b.open(now)
+			return
+		}
+		b.successes++
+		if b.successes >= b.halfOpenRequests {
+			b.state = breakerClosed
+			b.windowStart = now
+			b.requests = 0
+			b.failures = 0
+			logger.Info("Circuit breaker closed", "origin", b.origin)
+		}
+	}
+	// Outcomes of requests sent before the breaker opened are ignored
+}
+
+func (b *circuitBreaker) open(now time.Time) {
+	b.state = breakerOpen
+	b.openUntil = now.Add(b.openDuration)
+}
+
+// stateName returns the current state for stats
+func (b *circuitBreaker) stateName() string {
+	if b == nil {
+		return breakerClosed.String()
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state.String()
+}
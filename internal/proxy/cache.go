@@ -0,0 +1,591 @@
+package proxy
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ezhttp/ezhttp/internal/config"
+	"github.com/ezhttp/ezhttp/internal/logger"
+)
+
+// ResponseCache is the proxy's shared HTTP cache. Response bodies are kept
+// in a memory LRU bounded by maxBytes. With a disk directory every stored
+// response is also written there, bounded by diskMaxBytes, and bodies
+// evicted from memory are read back from disk on the next hit. The index of
+// all entries, without bodies, always stays in memory
+type ResponseCache struct {
+	maxBytes      int64
+	maxEntryBytes int64
+	diskDir       string
+	diskMaxBytes  int64
+	lockTimeout   time.Duration
+
+	mu        sync.Mutex
+	entries   map[string][]*cacheEntry // variants by primary key
+	memory    *list.List               // entries with their body in memory, most recent first
+	memBytes  int64
+	disk      *list.List // entries written to disk, most recent first
+	diskBytes int64
+	inflight  map[string]*cacheFlight
+}
+
+// cacheEntry is one stored response. Entries are replaced, never updated,
+// except for where their body lives
+type cacheEntry struct {
+	key          string // host and request URI
+	id           string // file name on disk
+	varyNames    []string
+	varyValues   []string
+	status       int
+	header       http.Header
+	size         int64
+	requestTime  time.Time
+	responseTime time.Time
+
+	cc         cacheControl
+	lifetime   time.Duration
+	initialAge time.Duration
+
+	body     []byte // only while in memory
+	onDisk   bool
+	indexed  bool
+	memElem  *list.Element
+	diskElem *list.Element
+}
+
+// cacheMeta is the on-disk form of an entry, its body is stored next to it
+type cacheMeta struct {
+	Key          string
+	VaryNames    []string
+	VaryValues   []string
+	Status       int
+	Header       http.Header
+	Size         int64
+	RequestTime  time.Time
+	ResponseTime time.Time
+}
+
+// cacheFlight is a miss or revalidation in progress, later requests for the
+// same URL wait for it
+type cacheFlight struct {
+	done chan struct{}
+}
+
+// NewResponseCache creates the response cache, loading entries already on
+// disk. Returns nil when the cache is disabled
+func NewResponseCache(cfg *config.DataConfigProxyCache) (*ResponseCache, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+
+	c := &ResponseCache{
+		maxBytes:      cfg.MaxBytes,
+		maxEntryBytes: cfg.MaxEntryBytes,
+		diskDir:       cfg.DiskDir,
+		diskMaxBytes:  cfg.DiskMaxBytes,
+		lockTimeout:   5 * time.Second,
+		entries:       make(map[string][]*cacheEntry),
+		memory:        list.New(),
+		disk:          list.New(),
+		inflight:      make(map[string]*cacheFlight),
+	}
+	if cfg.LockTimeout != "" {
+		if d, err := time.ParseDuration(cfg.LockTimeout); err == nil {
+			c.lockTimeout = d
+		}
+	}
+
+	if c.diskDir != "" {
+		if err := os.MkdirAll(c.diskDir, 0o750); err != nil {
+			return nil, err
+		}
+		if err := c.loadDisk(); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// cacheKey is the primary cache key of a request: its host and target URI
+func cacheKey(r *http.Request) string {
+	return strings.ToLower(r.Host) + r.URL.RequestURI()
+}
+
+// newCacheEntry builds an entry and derives its freshness from the stored
+// response
+func newCacheEntry(meta cacheMeta, body []byte) *cacheEntry {
+	sum := sha256.Sum256([]byte(meta.Key + "\x00" + strings.Join(meta.VaryValues, "\x00")))
+	cc := parseCacheControl(meta.Header)
+	return &cacheEntry{
+		key:          meta.Key,
+		id:           hex.EncodeToString(sum[:16]),
+		varyNames:    meta.VaryNames,
+		varyValues:   meta.VaryValues,
+		status:       meta.Status,
+		header:       meta.Header,
+		size:         meta.Size,
+		requestTime:  meta.RequestTime,
+		responseTime: meta.ResponseTime,
+		cc:           cc,
+		lifetime:     freshnessLifetime(meta.Status, meta.Header, cc, meta.ResponseTime),
+		initialAge:   initialAge(meta.Header, meta.RequestTime, meta.ResponseTime),
+		body:         body,
+	}
+}
+
+// varyRequest returns the names of the request headers a response varies on
+// and their values in the request
+func varyRequest(reqHeader http.Header, header http.Header) (names []string, values []string) {
+	for _, value := range header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	return names, varyValues(reqHeader, names)
+}
+
+func varyValues(reqHeader http.Header, names []string) []string {
+	values := make([]string, len(names))
+	for i, name := range names {
+		parts := reqHeader.Values(name)
+		for j := range parts {
+			parts[j] = strings.TrimSpace(parts[j])
+		}
+		values[i] = strings.Join(parts, ", ")
+	}
+	return values
+}
+
+// meta returns the on-disk form of the entry
+func (e *cacheEntry) meta() cacheMeta {
+	return cacheMeta{
+		Key:          e.key,
+		VaryNames:    e.varyNames,
+		VaryValues:   e.varyValues,
+		Status:       e.status,
+		Header:       e.header,
+		Size:         e.size,
+		RequestTime:  e.requestTime,
+		ResponseTime: e.responseTime,
+	}
+}
+
+// matches reports whether the entry was stored for the request's values of
+// the headers it varies on
+func (e *cacheEntry) matches(reqHeader http.Header) bool {
+	for i, value := range varyValues(reqHeader, e.varyNames) {
+		if value != e.varyValues[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// cost approximates the memory used by an entry
+func (e *cacheEntry) cost() int64 {
+	cost := e.size + int64(len(e.key))
+	for name, values := range e.header {
+		cost += int64(len(name))
+		for _, value := range values {
+			cost += int64(len(value))
+		}
+	}
+	return cost
+}
+
+// refresh returns the entry updated by a 304 response to its revalidation
+// (RFC 9111 section 4.3.4)
+func (e *cacheEntry) refresh(header http.Header, requestTime time.Time, responseTime time.Time) *cacheEntry {
+	meta := e.meta()
+	meta.Header = e.header.Clone()
+	for name, values := range header {
+		if name == "Content-Length" {
+			continue
+		}
+		meta.Header[name] = values
+	}
+	meta.RequestTime = requestTime
+	meta.ResponseTime = responseTime
+	return newCacheEntry(meta, nil)
+}
+
+// hasValidators reports whether the entry can be revalidated conditionally
+func (e *cacheEntry) hasValidators() bool {
+	return e.header.Get("ETag") != "" || e.header.Get("Last-Modified") != ""
+}
+
+// lookup returns the entry stored for the request and its body, nil when
+// there is none. Bodies only on disk are read back into memory
+func (c *ResponseCache) lookup(key string, reqHeader http.Header) (*cacheEntry, []byte) {
+	c.mu.Lock()
+	var entry *cacheEntry
+	for _, e := range c.entries[key] {
+		if e.matches(reqHeader) {
+			entry = e
+			break
+		}
+	}
+	if entry == nil {
+		c.mu.Unlock()
+		return nil, nil
+	}
+	if entry.diskElem != nil {
+		c.disk.MoveToFront(entry.diskElem)
+	}
+	if entry.memElem != nil {
+		c.memory.MoveToFront(entry.memElem)
+		body := entry.body
+		c.mu.Unlock()
+		return entry, body
+	}
+	c.mu.Unlock()
+
+	body, err := os.ReadFile(c.diskPath(entry.id, ".body"))
+	if err != nil || int64(len(body)) != entry.size {
+		logger.Warn("Failed to read cached response from disk", "error", err, "uri", entry.key)
+		c.mu.Lock()
+		removed := c.drop(entry)
+		c.mu.Unlock()
+		if removed {
+			c.removeFiles(entry.id)
+		}
+		return nil, nil
+	}
+
+	c.mu.Lock()
+	if entry.indexed && entry.memElem == nil {
+		entry.body = body
+		entry.memElem = c.memory.PushFront(entry)
+		c.memBytes += entry.cost()
+	}
+	removed := c.evict()
+	c.mu.Unlock()
+	c.removeFiles(removed...)
+	return entry, body
+}
+
+// store adds an entry, replacing the variant stored for the same request
+// header values
+func (c *ResponseCache) store(entry *cacheEntry, body []byte) {
+	if entry.size > c.maxEntryBytes {
+		return
+	}
+	if c.diskDir != "" {
+		if err := c.writeDisk(entry, body); err != nil {
+			logger.Warn("Failed to write cached response to disk", "error", err, "uri", entry.key)
+		} else {
+			entry.onDisk = true
+		}
+	}
+
+	c.mu.Lock()
+	var removed []string
+	variants := c.entries[entry.key]
+	for _, old := range variants {
+		if old.id == entry.id {
+			// Files of the same variant were just overwritten, unless
+			// writing them failed
+			if c.drop(old) && !entry.onDisk {
+				removed = append(removed, old.id)
+			}
+			break
+		}
+	}
+	if variants = c.entries[entry.key]; len(variants) >= maxCacheVariantsPerKey {
+		if c.drop(variants[0]) {
+			removed = append(removed, variants[0].id)
+		}
+	}
+
+	entry.body = body
+	entry.indexed = true
+	c.entries[entry.key] = append(c.entries[entry.key], entry)
+	entry.memElem = c.memory.PushFront(entry)
+	c.memBytes += entry.cost()
+	if entry.onDisk {
+		entry.diskElem = c.disk.PushFront(entry)
+		c.diskBytes += entry.size
+	}
+	removed = append(removed, c.evict()...)
+	c.mu.Unlock()
+
+	c.removeFiles(removed...)
+}
+
+// evict drops bodies from memory and entries from disk over the size
+// limits. Returns the ids of the files to remove. Called with mu held
+func (c *ResponseCache) evict() []string {
+	var removed []string
+	dropped := 0
+	for c.memBytes > c.maxBytes && c.memory.Len() > 0 {
+		e := c.memory.Back().Value.(*cacheEntry)
+		if !e.onDisk {
+			c.drop(e)
+			dropped++
+			continue
+		}
+		c.memory.Remove(e.memElem)
+		c.memBytes -= e.cost()
+		e.memElem = nil
+		e.body = nil
+	}
+	for c.diskDir != "" && c.diskBytes > c.diskMaxBytes && c.disk.Len() > 0 {
+		e := c.disk.Back().Value.(*cacheEntry)
+		c.drop(e)
+		removed = append(removed, e.id)
+		dropped++
+	}
+	if dropped > 0 {
+		logger.Debug("Evicted proxy cache entries", "count", dropped, "bytes", c.memBytes, "disk_bytes", c.diskBytes)
+	}
+	return removed
+}
+
+// drop removes an entry from the index. Returns whether it has files on
+// disk. Called with mu held
+func (c *ResponseCache) drop(e *cacheEntry) bool {
+	if !e.indexed {
+		return false
+	}
+	e.indexed = false
+	if e.memElem != nil {
+		c.memory.Remove(e.memElem)
+		c.memBytes -= e.cost()
+		e.memElem = nil
+	}
+	if e.diskElem != nil {
+		c.disk.Remove(e.diskElem)
+		c.diskBytes -= e.size
+		e.diskElem = nil
+	}
+
+	variants := c.entries[e.key]
+	for i, variant := range variants {
+		if variant == e {
+			variants = append(variants[:i:i], variants[i+1:]...)
+			break
+		}
+	}
+	if len(variants) == 0 {
+		delete(c.entries, e.key)
+	} else {
+		c.entries[e.key] = variants
+	}
+	return e.onDisk
+}
+
+// invalidate removes every variant stored for the key
+func (c *ResponseCache) invalidate(key string) {
+	c.mu.Lock()
+	var removed []string
+	for _, e := range append([]*cacheEntry(nil), c.entries[key]...) {
+		if c.drop(e) {
+			removed = append(removed, e.id)
+		}
+	}
+	c.mu.Unlock()
+	c.removeFiles(removed...)
+}
+
+// Purge removes the entries for host (any when empty) whose path equals
+// path or starts with prefix. Without path and prefix every entry of the
+// host is removed. Returns the number of entries removed
+func (c *ResponseCache) Purge(host string, path string, prefix string) int {
+	host = strings.ToLower(host)
+
+	c.mu.Lock()
+	var removed []string
+	count := 0
+	for key, variants := range c.entries {
+		slash := strings.IndexByte(key, '/')
+		if slash < 0 {
+			continue
+		}
+		keyPath, _, _ := strings.Cut(key[slash:], "?")
+		switch {
+		case host != "" && key[:slash] != host:
+			continue
+		case path != "" && keyPath != path:
+			continue
+		case prefix != "" && !strings.HasPrefix(keyPath, prefix):
+			continue
+		}
+		for _, e := range append([]*cacheEntry(nil), variants...) {
+			if c.drop(e) {
+				removed = append(removed, e.id)
+			}
+			count++
+		}
+	}
+	c.mu.Unlock()
+
+	c.removeFiles(removed...)
+	return count
+}
+
+// join registers a miss or revalidation of the key. Returns the flight
+// already in progress and false, or a new one and true when the caller
+// leads it and must call leave
+func (c *ResponseCache) join(key string) (*cacheFlight, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if flight, ok := c.inflight[key]; ok {
+		return flight, false
+	}
+	flight := &cacheFlight{done: make(chan struct{})}
+	c.inflight[key] = flight
+	return flight, true
+}
+
+// leave ends a flight and wakes up the requests waiting for it
+func (c *ResponseCache) leave(key string, flight *cacheFlight) {
+	c.mu.Lock()
+	if c.inflight[key] == flight {
+		delete(c.inflight, key)
+	}
+	c.mu.Unlock()
+	close(flight.done)
+}
+
+// wait waits up to the lock timeout for a flight. Returns false when the
+// flight did not finish in time or the request was cancelled
+func (c *ResponseCache) wait(ctx context.Context, flight *cacheFlight) bool {
+	timer := time.NewTimer(c.lockTimeout)
+	defer timer.Stop()
+	select {
+	case <-flight.done:
+		return true
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (c *ResponseCache) diskPath(id string, ext string) string {
+	return filepath.Join(c.diskDir, id+ext)
+}
+
+// writeDisk writes the body and then the metadata of an entry, each
+// atomically; an entry is only complete once its metadata exists
+func (c *ResponseCache) writeDisk(e *cacheEntry, body []byte) error {
+	if err := writeFileAtomic(c.diskPath(e.id, ".body"), func(f *os.File) error {
+		_, err := f.Write(body)
+		return err
+	}); err != nil {
+		return err
+	}
+	return writeFileAtomic(c.diskPath(e.id, ".meta"), func(f *os.File) error {
+		return gob.NewEncoder(f).Encode(e.meta())
+	})
+}
+
+// writeFileAtomic writes a file through a temporary file in its directory
+func writeFileAtomic(path string, write func(*os.File) error) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	err = write(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// removeFiles deletes the files of entries dropped from disk
+func (c *ResponseCache) removeFiles(ids ...string) {
+	for _, id := range ids {
+		os.Remove(c.diskPath(id, ".meta"))
+		os.Remove(c.diskPath(id, ".body"))
+	}
+}
+
+// loadDisk indexes the entries found in the disk directory, dropping
+// incomplete ones and leftovers of interrupted writes
+func (c *ResponseCache) loadDisk() error {
+	files, err := os.ReadDir(c.diskDir)
+	if err != nil {
+		return err
+	}
+
+	var loaded []*cacheEntry
+	for _, file := range files {
+		name := file.Name()
+		switch {
+		case strings.HasSuffix(name, ".tmp"):
+			os.Remove(filepath.Join(c.diskDir, name))
+		case strings.HasSuffix(name, ".meta"):
+			entry, err := c.readMeta(strings.TrimSuffix(name, ".meta"))
+			if err != nil {
+				logger.Warn("Dropping unreadable cached response", "error", err, "file", name)
+				c.removeFiles(strings.TrimSuffix(name, ".meta"))
+				continue
+			}
+			loaded = append(loaded, entry)
+		}
+	}
+
+	// Oldest first, so the most recent responses end up at the front
+	sort.Slice(loaded, func(i, j int) bool {
+		return loaded[i].responseTime.Before(loaded[j].responseTime)
+	})
+	for _, e := range loaded {
+		e.onDisk = true
+		e.indexed = true
+		c.entries[e.key] = append(c.entries[e.key], e)
+		e.diskElem = c.disk.PushFront(e)
+		c.diskBytes += e.size
+	}
+	c.removeFiles(c.evict()...)
+
+	if len(loaded) > 0 {
+		logger.Info("Loaded proxy cache from disk", "entries", len(loaded), "bytes", c.diskBytes)
+	}
+	return nil
+}
+
+// readMeta reads the metadata of an entry and checks its body is complete
+func (c *ResponseCache) readMeta(id string) (*cacheEntry, error) {
+	f, err := os.Open(c.diskPath(id, ".meta"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var meta cacheMeta
+	if err := gob.NewDecoder(f).Decode(&meta); err != nil {
+		return nil, err
+	}
+	entry := newCacheEntry(meta, nil)
+	if entry.id != id || len(meta.VaryNames) != len(meta.VaryValues) {
+		return nil, errors.New("cache metadata does not match its file")
+	}
+	info, err := os.Stat(c.diskPath(id, ".body"))
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() != meta.Size {
+		return nil, errors.New("cached body is incomplete")
+	}
+	return entry, nil
+}
@@ -0,0 +1,472 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ezhttp/ezhttp/internal/logger"
+	"github.com/ezhttp/ezhttp/internal/ratelimit"
+)
+
+// Background revalidations (stale-while-revalidate) give up after this long
+const backgroundRevalidateTimeout = 30 * time.Second
+
+// Request headers that make a request conditional, replaced by the cache's
+// own validators when it revalidates
+var conditionalHeaders = []string{"If-None-Match", "If-Modified-Since", "If-Match", "If-Unmodified-Since", "If-Range"}
+
+// cacheRecorder captures the response written by the proxy handler. Unless
+// hold keeps it from the client, the response is also passed through as it
+// is written
+type cacheRecorder struct {
+	client http.ResponseWriter // nil for background revalidations
+	hold   func(status int) bool
+	limit  int64
+
+	header       http.Header
+	status       int
+	body         bytes.Buffer
+	overflow     bool // body exceeded limit and was not kept
+	aborted      bool // body was cut short
+	held         bool
+	wroteHeader  bool
+	responseTime time.Time
+}
+
+func newCacheRecorder(client http.ResponseWriter, limit int64) *cacheRecorder {
+	return &cacheRecorder{client: client, limit: limit, header: make(http.Header)}
+}
+
+func (rec *cacheRecorder) Header() http.Header {
+	return rec.header
+}
+
+func (rec *cacheRecorder) WriteHeader(status int) {
+	if rec.wroteHeader {
+		return
+	}
+	rec.wroteHeader = true
+	rec.status = status
+	rec.responseTime = time.Now()
+	rec.held = rec.client == nil || (rec.hold != nil && rec.hold(status))
+	if rec.held {
+		return
+	}
+	clientHeader := rec.client.Header()
+	for k, vv := range rec.header {
+		clientHeader[k] = vv
+	}
+	rec.client.WriteHeader(status)
+}
+
+func (rec *cacheRecorder) Write(p []byte) (int, error) {
+	if !rec.wroteHeader {
+		rec.WriteHeader(http.StatusOK)
+	}
+	if !rec.overflow {
+		if int64(rec.body.Len()+len(p)) > rec.limit {
+			rec.overflow = true
+			rec.body = bytes.Buffer{}
+		} else {
+			rec.body.Write(p)
+		}
+	}
+	if rec.held {
+		return len(p), nil
+	}
+	return rec.client.Write(p)
+}
+
+// FlushError, SetReadDeadline and SetWriteDeadline let the handler control
+// the client connection through http.ResponseController
+func (rec *cacheRecorder) FlushError() error {
+	if rec.held || rec.client == nil {
+		return nil
+	}
+	return http.NewResponseController(rec.client).Flush()
+}
+
+func (rec *cacheRecorder) SetReadDeadline(t time.Time) error {
+	if rec.client == nil {
+		return http.ErrNotSupported
+	}
+	return http.NewResponseController(rec.client).SetReadDeadline(t)
+}
+
+func (rec *cacheRecorder) SetWriteDeadline(t time.Time) error {
+	if rec.client == nil {
+		return http.ErrNotSupported
+	}
+	return http.NewResponseController(rec.client).SetWriteDeadline(t)
+}
+
+// replay sends a held response to the client
+func (rec *cacheRecorder) replay(w http.ResponseWriter) {
+	if rec.overflow {
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+	for k, vv := range rec.header {
+		w.Header()[k] = vv
+	}
+	w.WriteHeader(rec.status)
+	w.Write(rec.body.Bytes())
+}
+
+// abortResponse marks a response whose body was cut short so the cache does
+// not store it
+func abortResponse(w http.ResponseWriter) {
+	if rec, ok := w.(*cacheRecorder); ok {
+		rec.aborted = true
+	}
+}
+
+// Middleware answers GET and HEAD requests from the cache and stores the
+// cacheable responses of the handler. Successful requests with other unsafe
+// methods invalidate what they changed. The outcome is reported in X-Cache:
+// HIT, STALE, REVALIDATED, MISS or BYPASS
+func (c *ResponseCache) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method != http.MethodGet && r.Method != http.MethodHead:
+			c.serveUnsafe(w, r, next)
+		case !cacheableRequest(r):
+			w.Header().Set("X-Cache", "BYPASS")
+			next.ServeHTTP(w, r)
+		default:
+			c.serve(w, r, next)
+		}
+	})
+}
+
+// cacheableRequest reports whether the cache may answer the request. Upgrades,
+// range requests and requests forbidding storage go to the origin
+func cacheableRequest(r *http.Request) bool {
+	if r.Header.Get("Upgrade") != "" || r.Header.Get("Range") != "" {
+		return false
+	}
+	return !parseCacheControl(r.Header).has("no-store")
+}
+
+// originRequestHeader returns the client's request headers that reach the
+// origin, which is what a stored response may depend on
+func originRequestHeader(r *http.Request) http.Header {
+	header := r.Header.Clone()
+	removeHopByHopHeaders(header)
+	route := RouteFromContext(r.Context())
+	if route == nil {
+		removeSensitiveRequestHeaders(header, nil)
+		header.Del("Cookie")
+		return header
+	}
+	removeSensitiveRequestHeaders(header, route.headers.allowSensitive)
+	route.cookies.forward(header)
+	return header
+}
+
+// serveUnsafe forwards a request that may change the resource and
+// invalidates the stored responses for it (RFC 9111 section 4.4)
+func (c *ResponseCache) serveUnsafe(w http.ResponseWriter, r *http.Request, next http.Handler) {
+	switch r.Method {
+	case http.MethodOptions, http.MethodTrace:
+		next.ServeHTTP(w, r)
+		return
+	}
+
+	rec := newCacheRecorder(w, 0)
+	next.ServeHTTP(rec, r)
+	if !rec.wroteHeader || rec.status >= 400 {
+		return
+	}
+
+	c.invalidate(cacheKey(r))
+	for _, name := range []string{"Location", "Content-Location"} {
+		value := rec.header.Get(name)
+		if value == "" {
+			continue
+		}
+		target, err := r.URL.Parse(value)
+		if err == nil && (target.Host == "" || strings.EqualFold(target.Host, r.Host)) {
+			c.invalidate(strings.ToLower(r.Host) + target.RequestURI())
+		}
+	}
+}
+
+// serve answers a GET or HEAD request from the cache, the origin or both
+func (c *ResponseCache) serve(w http.ResponseWriter, r *http.Request, next http.Handler) {
+	key := cacheKey(r)
+	reqCC := parseRequestCacheControl(r.Header)
+
+	entry, body := c.lookup(key, r.Header)
+	if entry != nil {
+		switch entry.evaluate(reqCC, time.Now()) {
+		case cacheFresh:
+			c.writeEntry(w, r, entry, body, "HIT")
+			return
+		case cacheStale:
+			c.writeEntry(w, r, entry, body, "STALE")
+			return
+		case cacheStaleRevalidate:
+			c.writeEntry(w, r, entry, body, "STALE")
+			c.revalidateInBackground(r, next, key, entry, body)
+			return
+		}
+	}
+
+	if reqCC.has("only-if-cached") {
+		w.Header().Set("X-Cache", "MISS")
+		http.Error(w, "Gateway Timeout", http.StatusGatewayTimeout)
+		return
+	}
+	if r.Method == http.MethodHead {
+		w.Header().Set("X-Cache", "MISS")
+		next.ServeHTTP(w, r)
+		return
+	}
+
+	// Concurrent misses and revalidations of the URL wait for the first one
+	// instead of all reaching the origin
+	if c.lockTimeout > 0 {
+		flight, leader := c.join(key)
+		if leader {
+			defer c.leave(key, flight)
+		} else if c.wait(r.Context(), flight) {
+			entry, body = c.lookup(key, r.Header)
+			if entry != nil && entry.evaluate(reqCC, time.Now()) == cacheFresh {
+				c.writeEntry(w, r, entry, body, "HIT")
+				return
+			}
+		}
+		if r.Context().Err() != nil {
+			return
+		}
+	}
+
+	c.fetch(w, r, next, key, entry, body, reqCC)
+}
+
+// fetch forwards the request to the origin, revalidating the stale entry
+// when there is one. A 304 refreshes the entry, an error is answered from it
+// when stale-if-error allows, anything else is passed to the client and
+// stored when cacheable
+func (c *ResponseCache) fetch(w http.ResponseWriter, r *http.Request, next http.Handler, key string, stale *cacheEntry, staleBody []byte, reqCC cacheControl) {
+	originReq := r
+	validating := false
+	staleOnError := false
+	if stale != nil {
+		originReq = conditionalRequest(r, stale)
+		validating = stale.hasValidators()
+		staleOnError = stale.staleIfError(reqCC, time.Now())
+	}
+
+	rec := newCacheRecorder(w, c.maxEntryBytes)
+	rec.hold = func(status int) bool {
+		if (validating && status == http.StatusNotModified) || (staleOnError && status >= 500) {
+			return true
+		}
+		w.Header().Set("X-Cache", "MISS")
+		return false
+	}
+	requestTime := time.Now()
+	next.ServeHTTP(rec, originReq)
+
+	switch {
+	case rec.held && rec.status == http.StatusNotModified:
+		refreshed := stale.refresh(rec.header, requestTime, rec.responseTime)
+		c.store(refreshed, staleBody)
+		c.writeEntry(w, r, refreshed, staleBody, "REVALIDATED")
+	case rec.held && r.Context().Err() == nil && stale.staleIfError(reqCC, time.Now()):
+		logger.Warn("Serving stale cached response after origin error", "uri", key, "status", rec.status)
+		c.writeEntry(w, r, stale, staleBody, "STALE")
+	case rec.held:
+		w.Header().Set("X-Cache", "MISS")
+		rec.replay(w)
+	default:
+		c.storeResponse(originReq, key, rec, requestTime)
+	}
+}
+
+// revalidateInBackground refreshes a stale entry after it was served
+// (stale-while-revalidate). Only one revalidation per URL runs at a time
+func (c *ResponseCache) revalidateInBackground(r *http.Request, next http.Handler, key string, stale *cacheEntry, staleBody []byte) {
+	flight, leader := c.join(key)
+	if !leader {
+		return
+	}
+
+	// The revalidation outlives the client request
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), backgroundRevalidateTimeout)
+	originReq := conditionalRequest(r.WithContext(ctx), stale)
+	originReq.Method = http.MethodGet
+
+	go func() {
+		defer c.leave(key, flight)
+		defer cancel()
+
+		rec := newCacheRecorder(nil, c.maxEntryBytes)
+		requestTime := time.Now()
+		next.ServeHTTP(rec, originReq)
+
+		if rec.status == http.StatusNotModified && stale.hasValidators() {
+			c.store(stale.refresh(rec.header, requestTime, rec.responseTime), staleBody)
+			return
+		}
+		if rec.status >= 500 || !rec.wroteHeader {
+			logger.Warn("Background cache revalidation failed", "uri", key, "status", rec.status)
+			return
+		}
+		c.storeResponse(originReq, key, rec, requestTime)
+	}()
+}
+
+// conditionalRequest copies the request for revalidating the entry, with the
+// entry's validators instead of the client's conditions
+func conditionalRequest(r *http.Request, e *cacheEntry) *http.Request {
+	originReq := r.Clone(r.Context())
+	originReq.Body = http.NoBody
+	originReq.ContentLength = 0
+	for _, name := range conditionalHeaders {
+		originReq.Header.Del(name)
+	}
+	if etag := e.header.Get("ETag"); etag != "" {
+		originReq.Header.Set("If-None-Match", etag)
+	}
+	if lastModified := e.header.Get("Last-Modified"); lastModified != "" {
+		originReq.Header.Set("If-Modified-Since", lastModified)
+	}
+	return originReq
+}
+
+// storeResponse stores a complete, cacheable response
+func (c *ResponseCache) storeResponse(r *http.Request, key string, rec *cacheRecorder, requestTime time.Time) {
+	if r.Method != http.MethodGet || !rec.wroteHeader || rec.overflow || rec.aborted || r.Context().Err() != nil {
+		return
+	}
+	if !isStorable(originRequestHeader(r), rec.status, rec.header) {
+		return
+	}
+	if length := rec.header.Get("Content-Length"); length != "" && length != strconv.Itoa(rec.body.Len()) {
+		return
+	}
+
+	varyNames, varyValues := varyRequest(r.Header, rec.header)
+	entry := newCacheEntry(cacheMeta{
+		Key:          key,
+		VaryNames:    varyNames,
+		VaryValues:   varyValues,
+		Status:       rec.status,
+		Header:       rec.header,
+		Size:         int64(rec.body.Len()),
+		RequestTime:  requestTime,
+		ResponseTime: rec.responseTime,
+	}, nil)
+	c.store(entry, rec.body.Bytes())
+	logger.Debug("Stored proxy response in cache", "uri", key, "status", rec.status, "size", entry.size, "ttl", entry.lifetime.String())
+}
+
+// writeEntry answers the request with a stored response, or with 304 when
+// the client's own validators match it
+func (c *ResponseCache) writeEntry(w http.ResponseWriter, r *http.Request, e *cacheEntry, body []byte, cacheStatus string) {
+	header := w.Header()
+	for k, vv := range e.header {
+		header[k] = vv
+	}
+	header.Set("Age", strconv.FormatInt(int64(e.currentAge(time.Now())/time.Second), 10))
+	header.Set("X-Cache", cacheStatus)
+
+	status := e.status
+	switch {
+	case status == http.StatusOK && notModified(r, e.header):
+		status = http.StatusNotModified
+		header.Del("Content-Length")
+		header.Del("Content-Type")
+	case status == http.StatusNoContent:
+		header.Del("Content-Length")
+	default:
+		header.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	w.WriteHeader(status)
+	if status != http.StatusNotModified && status != http.StatusNoContent && r.Method != http.MethodHead {
+		w.Write(body)
+	}
+
+	logger.Info("Proxy request",
+		"method", r.Method,
+		"path", r.URL.Path,
+		"status", status,
+		"cache", cacheStatus,
+		"ip", ratelimit.ExtractIP(r.RemoteAddr))
+}
+
+// notModified evaluates the client's If-None-Match, or else
+// If-Modified-Since, against a stored response
+func notModified(r *http.Request, header http.Header) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		etag := strings.TrimPrefix(header.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lastModified, err := http.ParseTime(header.Get("Last-Modified"))
+	return err == nil && !lastModified.After(since)
+}
+
+// PurgeMiddleware serves the cache purge endpoint. POST or DELETE on path
+// with the bearer token removes the entries matching the "host", "path" and
+// "prefix" query parameters, every entry without any, and answers with the
+// number removed. Like /health it bypasses the proxy authentication
+func PurgeMiddleware(cache *ResponseCache, path string, token string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != path {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			clientIP := ratelimit.ExtractIP(r.RemoteAddr)
+			w.Header().Set("Cache-Control", "no-store")
+			if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+				w.Header().Set("Allow", "POST, DELETE")
+				http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) != 1 {
+				logger.Warn("Unauthorized cache purge", "ip", clientIP)
+				w.Header().Set("WWW-Authenticate", `Bearer realm="cache"`)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+
+			query := r.URL.Query()
+			purged := cache.Purge(query.Get("host"), query.Get("path"), query.Get("prefix"))
+			logger.Info("Purged proxy cache",
+				"host", query.Get("host"),
+				"uri", query.Get("path"),
+				"prefix", query.Get("prefix"),
+				"count", purged,
+				"ip", clientIP)
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]int{"purged": purged})
+		})
+	}
+}
@@ -0,0 +1,219 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Heuristic freshness is 10% of the time since Last-Modified, at most a day
+const (
+	heuristicFraction      = 10
+	heuristicMaxFreshness  = 24 * time.Hour
+	maxDeltaSeconds        = 1<<31 - 1 // RFC 9111 section 1.2.2
+	maxCacheVariantsPerKey = 16
+)
+
+// Statuses that are cacheable by default (RFC 9110 section 15.1), plus
+// redirects cached only with explicit freshness
+var (
+	heuristicStatuses = map[int]bool{
+		200: true, 203: true, 204: true, 300: true, 301: true, 308: true,
+		404: true, 405: true, 410: true, 414: true, 501: true,
+	}
+	storableStatuses = map[int]bool{302: true, 307: true}
+)
+
+// cacheControl holds the directives of a Cache-Control header, lowercase,
+// with unquoted arguments
+type cacheControl map[string]string
+
+func parseCacheControl(h http.Header) cacheControl {
+	cc := cacheControl{}
+	for _, value := range h.Values("Cache-Control") {
+		for _, part := range strings.Split(value, ",") {
+			part = strings.TrimSpace(part)
+			if part == "" {
+				continue
+			}
+			name, arg, _ := strings.Cut(part, "=")
+			cc[strings.ToLower(strings.TrimSpace(name))] = strings.Trim(strings.TrimSpace(arg), `"`)
+		}
+	}
+	return cc
+}
+
+// parseRequestCacheControl also honors "Pragma: no-cache" from HTTP/1.0
+// clients that send no Cache-Control
+func parseRequestCacheControl(h http.Header) cacheControl {
+	cc := parseCacheControl(h)
+	if len(h.Values("Cache-Control")) == 0 && headerContainsToken(h, "Pragma", "no-cache") {
+		cc["no-cache"] = ""
+	}
+	return cc
+}
+
+func (cc cacheControl) has(directive string) bool {
+	_, found := cc[directive]
+	return found
+}
+
+// seconds returns a delta-seconds directive; ok is false when it is absent
+// or invalid
+func (cc cacheControl) seconds(directive string) (time.Duration, bool) {
+	value, found := cc[directive]
+	if !found {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return time.Duration(min(n, maxDeltaSeconds)) * time.Second, true
+}
+
+// isStorable reports whether a shared cache may store the response to a GET
+// request (RFC 9111 section 3). Responses setting cookies and event streams
+// are never stored
+func isStorable(reqHeader http.Header, status int, header http.Header) bool {
+	if !heuristicStatuses[status] && !storableStatuses[status] {
+		return false
+	}
+	if strings.HasPrefix(header.Get("Content-Type"), "text/event-stream") {
+		return false
+	}
+	cc := parseCacheControl(header)
+	if cc.has("no-store") || cc.has("private") || parseCacheControl(reqHeader).has("no-store") {
+		return false
+	}
+	if headerContainsToken(header, "Vary", "*") || header.Get("Set-Cookie") != "" {
+		return false
+	}
+
+	// Responses to requests with credentials need explicit permission
+	if reqHeader.Get("Authorization") != "" || reqHeader.Get("Cookie") != "" {
+		if !cc.has("public") && !cc.has("s-maxage") && !cc.has("must-revalidate") {
+			return false
+		}
+	}
+
+	explicit := cc.has("s-maxage") || cc.has("max-age") || header.Get("Expires") != ""
+	return explicit || cc.has("public") || heuristicStatuses[status]
+}
+
+// freshnessLifetime computes how long a response stays fresh (RFC 9111
+// section 4.2.1)
+func freshnessLifetime(status int, header http.Header, cc cacheControl, responseTime time.Time) time.Duration {
+	if d, ok := cc.seconds("s-maxage"); ok {
+		return d
+	}
+	if d, ok := cc.seconds("max-age"); ok {
+		return d
+	}
+
+	date := responseDate(header, responseTime)
+	if expires := header.Get("Expires"); expires != "" {
+		t, err := http.ParseTime(expires)
+		if err != nil || !t.After(date) {
+			// Invalid dates mean already expired
+			return 0
+		}
+		return t.Sub(date)
+	}
+
+	if !heuristicStatuses[status] && !cc.has("public") {
+		return 0
+	}
+	if lastModified, err := http.ParseTime(header.Get("Last-Modified")); err == nil && date.After(lastModified) {
+		return min(date.Sub(lastModified)/heuristicFraction, heuristicMaxFreshness)
+	}
+	return 0
+}
+
+// initialAge is the corrected initial age of a response (RFC 9111 section
+// 4.2.3); its current age adds the time since it was received
+func initialAge(header http.Header, requestTime time.Time, responseTime time.Time) time.Duration {
+	apparentAge := max(responseTime.Sub(responseDate(header, responseTime)), 0)
+	var ageValue time.Duration
+	if n, err := strconv.ParseInt(strings.TrimSpace(header.Get("Age")), 10, 64); err == nil && n > 0 {
+		ageValue = time.Duration(min(n, maxDeltaSeconds)) * time.Second
+	}
+	correctedAge := ageValue + responseTime.Sub(requestTime)
+	return max(apparentAge, correctedAge)
+}
+
+// responseDate returns the Date header, or the receive time without one
+func responseDate(header http.Header, responseTime time.Time) time.Time {
+	if date, err := http.ParseTime(header.Get("Date")); err == nil {
+		return date
+	}
+	return responseTime
+}
+
+// How a stored response may be used for a request
+type cacheDecision int
+
+const (
+	cacheFresh           cacheDecision = iota // serve it
+	cacheStale                                // serve it stale, the client accepts that
+	cacheStaleRevalidate                      // serve it stale and revalidate in the background
+	cacheRevalidate                           // validate it with the origin first
+)
+
+// evaluate decides how the entry may answer a request with the given
+// Cache-Control directives (RFC 9111 section 4 and RFC 5861)
+func (e *cacheEntry) evaluate(reqCC cacheControl, now time.Time) cacheDecision {
+	if e.cc.has("no-cache") || reqCC.has("no-cache") {
+		return cacheRevalidate
+	}
+
+	age := e.currentAge(now)
+	if maxAge, ok := reqCC.seconds("max-age"); ok && age > maxAge {
+		return cacheRevalidate
+	}
+	minFresh, _ := reqCC.seconds("min-fresh")
+	if e.lifetime > age+minFresh {
+		return cacheFresh
+	}
+
+	if !e.staleAllowed() {
+		return cacheRevalidate
+	}
+	staleness := age - e.lifetime
+	if value, found := reqCC["max-stale"]; found {
+		maxStale, ok := reqCC.seconds("max-stale")
+		if value == "" || (ok && staleness <= maxStale) {
+			return cacheStale
+		}
+	}
+	if swr, ok := e.cc.seconds("stale-while-revalidate"); ok && staleness <= swr {
+		return cacheStaleRevalidate
+	}
+	return cacheRevalidate
+}
+
+// staleIfError reports whether the entry may be served when revalidating
+// it failed, per stale-if-error of the response or the request
+func (e *cacheEntry) staleIfError(reqCC cacheControl, now time.Time) bool {
+	if !e.staleAllowed() {
+		return false
+	}
+	staleness := e.currentAge(now) - e.lifetime
+	for _, cc := range []cacheControl{e.cc, reqCC} {
+		if sie, ok := cc.seconds("stale-if-error"); ok && staleness <= sie {
+			return true
+		}
+	}
+	return false
+}
+
+// staleAllowed reports whether the response permits being served stale
+func (e *cacheEntry) staleAllowed() bool {
+	return !e.cc.has("must-revalidate") && !e.cc.has("proxy-revalidate") && !e.cc.has("s-maxage") && !e.cc.has("no-cache")
+}
+
+// currentAge is the age of the entry now
+func (e *cacheEntry) currentAge(now time.Time) time.Duration {
+	return e.initialAge + now.Sub(e.responseTime)
+}
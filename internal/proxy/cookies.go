@@ -0,0 +1,140 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/ezhttp/ezhttp/internal/config"
+)
+
+// Cookie policies for the Cookie request header
+const (
+	cookiesStrip     = "strip"
+	cookiesPass      = "pass"
+	cookiesAllowlist = "allowlist"
+)
+
+// cookiePolicy decides which request cookies reach the origin and rewrites
+// the cookies the origin sets for the public host
+type cookiePolicy struct {
+	policy   string
+	allow    map[string]bool
+	domain   string
+	secure   bool
+	sameSite string
+}
+
+func newCookiePolicy(cfg *config.DataConfigCookies) *cookiePolicy {
+	cp := &cookiePolicy{
+		policy:   strings.ToLower(cfg.Policy),
+		allow:    make(map[string]bool),
+		domain:   cfg.Domain,
+		secure:   cfg.Secure,
+		sameSite: cfg.SameSite,
+	}
+	if cp.policy == "" {
+		cp.policy = cookiesStrip
+	}
+	for _, name := range cfg.Allow {
+		cp.allow[name] = true
+	}
+	// Browsers drop SameSite=None cookies without Secure
+	if strings.EqualFold(cp.sameSite, "None") {
+		cp.secure = true
+	}
+	return cp
+}
+
+// forward applies the policy to the Cookie header of an origin request
+func (cp *cookiePolicy) forward(h http.Header) {
+	switch cp.policy {
+	case cookiesPass:
+		return
+	case cookiesAllowlist:
+		var kept []string
+		for _, line := range h.Values("Cookie") {
+			for _, pair := range strings.Split(line, ";") {
+				pair = strings.TrimSpace(pair)
+				name, _, _ := strings.Cut(pair, "=")
+				if cp.allow[name] {
+					kept = append(kept, pair)
+				}
+			}
+		}
+		h.Del("Cookie")
+		if len(kept) > 0 {
+			h.Set("Cookie", strings.Join(kept, "; "))
+		}
+	default:
+		h.Del("Cookie")
+	}
+}
+
+// rewriteSetCookies adapts the origin's cookies to the public host and path
+// of the request
+func (cp *cookiePolicy) rewriteSetCookies(h http.Header, r *http.Request, route *Route) {
+	cookies := h.Values("Set-Cookie")
+	if len(cookies) == 0 {
+		return
+	}
+	host := strings.ToLower(r.Host)
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+
+	rewritten := make([]string, len(cookies))
+	for i, cookie := range cookies {
+		rewritten[i] = cp.rewriteSetCookie(cookie, host, route)
+	}
+	h["Set-Cookie"] = rewritten
+}
+
+// rewriteSetCookie rewrites the attributes of one Set-Cookie value. A Domain
+// not covering the public host is replaced by the configured domain, or
+// removed to make a host-only cookie. Other attributes are kept as they are
+func (cp *cookiePolicy) rewriteSetCookie(cookie string, host string, route *Route) string {
+	parts := strings.Split(cookie, ";")
+	attrs := []string{strings.TrimSpace(parts[0])}
+	hasSecure, hasSameSite := false, false
+	for _, part := range parts[1:] {
+		part = strings.TrimSpace(part)
+		name, value, _ := strings.Cut(part, "=")
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "domain":
+			switch {
+			case domainMatches(host, value):
+			case cp.domain != "":
+				part = "Domain=" + cp.domain
+			default:
+				continue
+			}
+		case "path":
+			part = "Path=" + route.PublicPath(strings.TrimSpace(value))
+		case "secure":
+			hasSecure = true
+		case "samesite":
+			hasSameSite = true
+			if cp.sameSite != "" {
+				part = "SameSite=" + cp.sameSite
+			}
+		case "":
+			continue
+		}
+		attrs = append(attrs, part)
+	}
+
+	if cp.sameSite != "" && !hasSameSite {
+		attrs = append(attrs, "SameSite="+cp.sameSite)
+	}
+	if cp.secure && !hasSecure {
+		attrs = append(attrs, "Secure")
+	}
+	return strings.Join(attrs, "; ")
+}
+
+// domainMatches reports whether a cookie Domain covers the host
+func domainMatches(host string, domain string) bool {
+	domain = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(domain), "."))
+	return domain != "" && (host == domain || strings.HasSuffix(host, "."+domain))
+}
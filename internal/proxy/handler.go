@@ -1,6 +1,8 @@
 package proxy
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -15,36 +17,62 @@ import (
 	tlsconfig "github.com/ezhttp/ezhttp/internal/tls"
 )
 
+// Causes of cancelled origin requests, mapped to 504 Gateway Timeout
+var (
+	errRequestTimeout        = errors.New("proxy request timeout")
+	errResponseHeaderTimeout = errors.New("timeout awaiting origin response headers")
+)
+
 type Handler struct {
-	originBaseURL *url.URL
-	transport     *http.Transport
-	config        *config.DataConfigProxy
-	debugMode     bool
+	router    *Router
+	transport *http.Transport
+	dialer    *net.Dialer
+	upgrade   *upgradeProxy
+	retry     *retryPolicy
+	config    *config.DataConfigProxy
+	debugMode bool
+
+	streamWriteTimeout time.Duration
 }
 
 // Creates a new proxy handler
 func NewHandler(cfg *config.DataConfigProxy) (*Handler, error) {
-	if cfg.OriginBaseURL == "" {
-		return nil, fmt.Errorf("proxy origin base URL is required")
-	}
-
-	originBaseURL, err := url.Parse(cfg.OriginBaseURL)
+	router, err := NewRouter(cfg)
 	if err != nil {
-		return nil, fmt.Errorf("invalid origin base URL: %w", err)
+		return nil, err
 	}
 
 	h := &Handler{
-		originBaseURL: originBaseURL,
-		config:        cfg,
-		debugMode:     cfg.DebugMode,
+		router:    router,
+		config:    cfg,
+		debugMode: cfg.DebugMode,
+
+		streamWriteTimeout: 30 * time.Second,
+	}
+	if cfg.StreamWriteTimeout != "" {
+		if d, err := time.ParseDuration(cfg.StreamWriteTimeout); err == nil && d > 0 {
+			h.streamWriteTimeout = d
+		}
 	}
 
 	// Create transport with security settings
 	h.transport = h.createTransport()
+	h.upgrade = newUpgradeProxy(&cfg.Upgrade, h.dialer, h.transport.TLSClientConfig, h.transport.TLSHandshakeTimeout)
+	h.retry = newRetryPolicy(&cfg.Retry)
 
 	return h, nil
 }
 
+// Transport returns the transport used for origin requests
+func (h *Handler) Transport() *http.Transport {
+	return h.transport
+}
+
+// Router returns the routes and their upstream pools
+func (h *Handler) Router() *Router {
+	return h.router
+}
+
 // Creates HTTP transport with appropriate security settings
 func (h *Handler) createTransport() *http.Transport {
 	// Parse idle connection timeout
@@ -55,10 +83,29 @@ func (h *Handler) createTransport() *http.Transport {
 		}
 	}
 
+	// Parse connect timeouts
+	dialTimeout := 10 * time.Second
+	if h.config.DialTimeout != "" {
+		if d, err := time.ParseDuration(h.config.DialTimeout); err == nil {
+			dialTimeout = d
+		}
+	}
+	tlsHandshakeTimeout := 10 * time.Second
+	if h.config.TLSHandshakeTimeout != "" {
+		if d, err := time.ParseDuration(h.config.TLSHandshakeTimeout); err == nil {
+			tlsHandshakeTimeout = d
+		}
+	}
+	h.dialer = &net.Dialer{
+		Timeout:   dialTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+
 	transport := &http.Transport{
+		DialContext:         h.dialer.DialContext,
 		MaxIdleConns:        h.config.MaxIdleConns,
 		IdleConnTimeout:     idleConnTimeout,
-		TLSHandshakeTimeout: 10 * time.Second,
+		TLSHandshakeTimeout: tlsHandshakeTimeout,
 		DisableCompression:  false,
 	}
 
@@ -91,67 +138,158 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			"headers", fmt.Sprintf("%v", r.Header))
 	}
 
-	// Create new request for backend
-	originURL := *h.originBaseURL
-	originURL.Path = r.URL.Path
-	originURL.RawQuery = r.URL.RawQuery
-
-	proxyReq, err := http.NewRequest(r.Method, originURL.String(), r.Body)
-	if err != nil {
-		logger.Error("Failed to create proxy request", "error", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	// Resolve the route (normally done by RouteMiddleware)
+	route := RouteFromContext(r.Context())
+	if route == nil {
+		route = h.router.Match(r)
+	}
+	if route == nil {
+		logger.Warn("No proxy route", "host", r.Host, "path", r.URL.Path, "ip", clientIP)
+		http.Error(w, "Not Found", http.StatusNotFound)
 		return
 	}
 
-	// Clone headers efficiently (available in Go 1.13+)
-	proxyReq.Header = r.Header.Clone()
+	hc := &headerContext{r: r, route: route}
 
-	// Remove hop-by-hop headers
-	removeHopByHopHeaders(proxyReq.Header)
+	// Long-polling and streaming routes outlast the server's timeouts
+	rc := http.NewResponseController(w)
+	if writeTimeout := route.WriteTimeout(); writeTimeout > 0 {
+		extendDeadlines(rc, writeTimeout)
+	}
 
-	// Remove sensitive headers before forwarding
-	removeSensitiveRequestHeaders(proxyReq.Header)
+	// The origin request is cancelled when the client disconnects. The route
+	// timeout covers every attempt but not the body of a streamed response
+	ctx, cancel := context.WithCancelCause(r.Context())
+	defer cancel(nil)
+	var routeTimer *time.Timer
+	if timeout := route.Timeout(); timeout > 0 {
+		routeTimer = time.AfterFunc(timeout, func() {
+			cancel(errRequestTimeout)
+		})
+		defer routeTimer.Stop()
+	}
 
-	// Add X-Forwarded headers
-	if clientIP := r.RemoteAddr; clientIP != "" {
-		if prior, ok := proxyReq.Header["X-Forwarded-For"]; ok {
-			clientIP = strings.Join(prior, ", ") + ", " + clientIP
+	// WebSockets and other upgrades bypass the transport and are not retried
+	upgrade := h.upgrade.protocol(r)
+
+	// Buffer small bodies so failed attempts can be replayed
+	body := &requestBody{stream: r.Body, length: r.ContentLength}
+	if upgrade == "" {
+		var err error
+		body, err = h.retry.readBody(r)
+		if err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			logger.Warn("Failed to read request body", "error", err, "ip", clientIP)
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
 		}
-		proxyReq.Header.Set("X-Forwarded-For", clientIP)
-	}
-	proxyReq.Header.Set("X-Forwarded-Proto", "http")
-	if r.TLS != nil {
-		proxyReq.Header.Set("X-Forwarded-Proto", "https")
+		h.retry.budget.request()
 	}
-	proxyReq.Header.Set("X-Forwarded-Host", r.Host)
-	proxyReq.Header.Set("X-Real-IP", r.RemoteAddr)
 
-	// Debug logging for outgoing request
-	if h.debugMode {
-		logger.Debug("Outgoing backend request",
-			"method", proxyReq.Method,
-			"url", originURL.String(),
-			"headers", fmt.Sprintf("%v", proxyReq.Header))
+	// Pick the origin and track the request against it
+	origin := route.Pool.Pick(r)
+	if origin == nil {
+		logger.Error("No healthy upstream available", "path", r.URL.Path, "ip", clientIP)
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+		return
 	}
 
-	// Send request to backend
-	resp, err := h.transport.RoundTrip(proxyReq)
-	if err != nil {
-		logger.Error("Backend request failed", "error", err, "url", originURL.String())
+	var (
+		originURL     *url.URL
+		resp          *http.Response
+		err           error
+		tried         []*Origin
+		attemptCancel context.CancelCauseFunc
+	)
+	for attempt := 1; ; attempt++ {
+		origin.Acquire()
+
+		// Each attempt may wait ResponseHeaderTimeout for the headers
+		var attemptCtx context.Context
+		attemptCtx, attemptCancel = context.WithCancelCause(ctx)
+		var headerTimer *time.Timer
+		if timeout := route.ResponseHeaderTimeout(); timeout > 0 && upgrade == "" {
+			headerTimer = time.AfterFunc(timeout, func() {
+				attemptCancel(errResponseHeaderTimeout)
+			})
+		}
 
-		// Check if it's a timeout error
-		if err, ok := err.(net.Error); ok && err.Timeout() {
-			http.Error(w, "Gateway Timeout", http.StatusGatewayTimeout)
+		var proxyReq *http.Request
+		proxyReq, err = h.newProxyRequest(attemptCtx, r, hc, origin, body)
+		if err != nil {
+			attemptCancel(nil)
+			origin.Release()
+			logger.Error("Failed to create proxy request", "error", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 			return
 		}
+		originURL = proxyReq.URL
+
+		if upgrade != "" {
+			h.serveUpgrade(w, r, proxyReq, upgrade, hc, origin)
+			attemptCancel(nil)
+			origin.Release()
+			return
+		}
+
+		// Send request to backend
+		resp, err = h.transport.RoundTrip(proxyReq)
+		if headerTimer != nil {
+			headerTimer.Stop()
+		}
+		if r.Context().Err() == nil {
+			route.Pool.Report(origin, err == nil && resp.StatusCode < 500)
+		}
+
+		reason := ""
+		if ctx.Err() == nil {
+			reason = h.retry.retryReason(r, body, attempt, resp, err)
+		}
+		if reason == "" || !h.retry.budget.withdraw() {
+			break
+		}
+		tried = append(tried, origin)
+		next := route.Pool.Pick(r, tried...)
+		if next == nil {
+			break
+		}
+
+		logger.Warn("Retrying proxy request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"route", route.Name,
+			"attempt", attempt,
+			"reason", reason,
+			"failed", originURL.String(),
+			"next", next.URL.String(),
+			"ip", clientIP)
+		if resp != nil {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+			resp.Body.Close()
+		}
+		attemptCancel(nil)
+		origin.Release()
+		origin = next
+
+		// A cancelled wait fails the next attempt right away
+		h.retry.backoff(ctx, attempt)
+	}
+	defer origin.Release()
+	defer attemptCancel(nil)
 
-		// Check for context deadline exceeded
-		if strings.Contains(err.Error(), "context deadline exceeded") {
-			http.Error(w, "Gateway Timeout", http.StatusGatewayTimeout)
+	if err != nil {
+		if r.Context().Err() != nil {
+			logger.Info("Client disconnected before backend response", "url", originURL.String(), "ip", clientIP)
 			return
 		}
 
-		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		status := gatewayStatus(err)
+		logger.Error("Backend request failed", "error", err, "url", originURL.String(), "status", status)
+		http.Error(w, http.StatusText(status), status)
 		return
 	}
 	defer resp.Body.Close()
@@ -169,13 +307,25 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		responseHeaders[k] = vv
 	}
 	removeHopByHopHeaders(responseHeaders)
-	removeSensitiveResponseHeaders(responseHeaders)
+	removeSensitiveResponseHeaders(responseHeaders, route.headers.allowSensitive)
+	route.cookies.rewriteSetCookies(responseHeaders, r, route)
+	applyHeaderRules(route.headers.response, responseHeaders, hc)
+
+	// Streams run as long as the origin and the client keep them open
+	streaming := isStreamingResponse(r, resp)
+	if streaming && routeTimer != nil {
+		routeTimer.Stop()
+	}
 
 	// Write status code
 	w.WriteHeader(resp.StatusCode)
 
 	// Copy response body
-	if h.debugMode {
+	if streaming {
+		// Send the headers right away, the first event may take a while
+		rc.Flush()
+		_, err = copyStreaming(rc, w, resp.Body, h.streamWriteTimeout)
+	} else if h.debugMode {
 		// In debug mode, capture and log response body (limited to first 1KB)
 		var buf [1024]byte
 		n, _ := resp.Body.Read(buf[:])
@@ -193,18 +343,99 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		_, err = io.Copy(w, resp.Body)
 	}
 	if err != nil {
-		logger.Error("Failed to copy response body", "error", err)
+		abortResponse(w)
+		if r.Context().Err() != nil {
+			logger.Info("Client disconnected during response", "url", originURL.String(), "streaming", streaming, "ip", clientIP)
+		} else {
+			logger.Error("Failed to copy response body", "error", err)
+		}
 	}
 
 	// Log successful request
 	logger.Info("Proxy request",
 		"method", r.Method,
 		"path", r.URL.Path,
+		"route", route.Name,
 		"target", originURL.String(),
 		"status", resp.StatusCode,
+		"streaming", streaming,
 		"ip", clientIP)
 }
 
+// gatewayStatus maps a failed origin request to 504 Gateway Timeout when a
+// timeout expired (connect, TLS handshake, response headers or the whole
+// request) and to 502 Bad Gateway otherwise
+func gatewayStatus(err error) int {
+	if errors.Is(err, errRequestTimeout) || errors.Is(err, errResponseHeaderTimeout) || errors.Is(err, context.DeadlineExceeded) {
+		return http.StatusGatewayTimeout
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+// newProxyRequest builds the request for one attempt against the origin
+func (h *Handler) newProxyRequest(ctx context.Context, r *http.Request, hc *headerContext, origin *Origin, body *requestBody) (*http.Request, error) {
+	route := hc.route
+
+	// Create new request for backend
+	originURL := *origin.URL
+	originURL.Path = route.RewritePath(r.URL.Path)
+	originURL.RawQuery = r.URL.RawQuery
+
+	proxyReq, err := http.NewRequestWithContext(ctx, r.Method, originURL.String(), body.reader())
+	if err != nil {
+		return nil, err
+	}
+	proxyReq.ContentLength = body.length
+	if body.length == 0 {
+		proxyReq.Body = http.NoBody
+	}
+
+	// Clone headers efficiently (available in Go 1.13+)
+	proxyReq.Header = r.Header.Clone()
+
+	// Remove hop-by-hop headers
+	removeHopByHopHeaders(proxyReq.Header)
+
+	// Remove sensitive headers and the cookies the route does not pass
+	removeSensitiveRequestHeaders(proxyReq.Header, route.headers.allowSensitive)
+	route.cookies.forward(proxyReq.Header)
+
+	// Add X-Forwarded headers
+	if clientIP := r.RemoteAddr; clientIP != "" {
+		if prior, ok := proxyReq.Header["X-Forwarded-For"]; ok {
+			clientIP = strings.Join(prior, ", ") + ", " + clientIP
+		}
+		proxyReq.Header.Set("X-Forwarded-For", clientIP)
+	}
+	proxyReq.Header.Set("X-Forwarded-Proto", "http")
+	if r.TLS != nil {
+		proxyReq.Header.Set("X-Forwarded-Proto", "https")
+	}
+	proxyReq.Header.Set("X-Forwarded-Host", r.Host)
+	proxyReq.Header.Set("X-Real-IP", r.RemoteAddr)
+
+	// Configured rewrites, a Host rule changes the Host sent to the origin
+	applyHeaderRules(route.headers.request, proxyReq.Header, hc)
+	if host := proxyReq.Header.Get("Host"); host != "" {
+		proxyReq.Host = host
+		proxyReq.Header.Del("Host")
+	}
+
+	// Debug logging for outgoing request
+	if h.debugMode {
+		logger.Debug("Outgoing backend request",
+			"method", proxyReq.Method,
+			"url", originURL.String(),
+			"headers", fmt.Sprintf("%v", proxyReq.Header))
+	}
+
+	return proxyReq, nil
+}
+
 // Removes headers that shouldn't be forwarded
 func removeHopByHopHeaders(h http.Header) {
 	hopByHopHeaders := []string{
@@ -222,30 +453,3 @@ func removeHopByHopHeaders(h http.Header) {
 		h.Del(header)
 	}
 }
-
-// Removes sensitive headers before forwarding
-func removeSensitiveRequestHeaders(h http.Header) {
-	sensitiveHeaders := []string{
-		"Authorization",
-		"Cookie",
-		"Set-Cookie",
-		"X-Proxy-Password",
-		"X-Api-Key",
-		"X-Auth-Token",
-		"X-Access-Token",
-		"X-Secret-Token",
-		"Api-Key",
-		"Access-Token",
-		"Auth-Token",
-	}
-
-	for _, header := range sensitiveHeaders {
-		h.Del(header)
-	}
-}
-
-// Removes headers that reveal server info
-func removeSensitiveResponseHeaders(h http.Header) {
-	h.Del("Server")
-	h.Del("X-Powered-By")
-}
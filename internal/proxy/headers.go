@@ -0,0 +1,254 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/ezhttp/ezhttp/internal/config"
+	"github.com/ezhttp/ezhttp/internal/ratelimit"
+)
+
+// Headers stripped from requests before forwarding, unless a route allows
+// them. Cookie is left to the route's cookie policy
+var sensitiveRequestHeaders = []string{
+	"Authorization",
+	"Set-Cookie",
+	"X-Proxy-Password",
+	"X-Api-Key",
+	"X-Auth-Token",
+	"X-Access-Token",
+	"X-Secret-Token",
+	"Api-Key",
+	"Access-Token",
+	"Auth-Token",
+}
+
+// Headers that reveal server info, stripped from responses unless allowed
+var sensitiveResponseHeaders = []string{
+	"Server",
+	"X-Powered-By",
+}
+
+// Variables available in header rule values as ${name}
+var headerVariables = map[string]func(hc *headerContext) string{
+	"client_ip":  func(hc *headerContext) string { return ratelimit.ExtractIP(hc.r.RemoteAddr) },
+	"request_id": func(hc *headerContext) string { return hc.requestID() },
+	"route":      func(hc *headerContext) string { return hc.route.Name },
+	"host":       func(hc *headerContext) string { return hc.r.Host },
+	"method":     func(hc *headerContext) string { return hc.r.Method },
+	"path":       func(hc *headerContext) string { return hc.r.URL.Path },
+	"scheme": func(hc *headerContext) string {
+		if hc.r.TLS != nil {
+			return "https"
+		}
+		return "http"
+	},
+	"tls_version": func(hc *headerContext) string {
+		if hc.r.TLS == nil {
+			return ""
+		}
+		return tls.VersionName(hc.r.TLS.Version)
+	},
+	"tls_cipher": func(hc *headerContext) string {
+		if hc.r.TLS == nil {
+			return ""
+		}
+		return tls.CipherSuiteName(hc.r.TLS.CipherSuite)
+	},
+	"tls_server_name": func(hc *headerContext) string {
+		if hc.r.TLS == nil {
+			return ""
+		}
+		return hc.r.TLS.ServerName
+	},
+}
+
+// headerRules rewrite the headers of a route's origin requests and responses
+type headerRules struct {
+	request        []headerRule
+	response       []headerRule
+	allowSensitive map[string]bool // canonical names
+}
+
+// headerRule is one "set", "add", "remove" or "rename" of a header
+type headerRule struct {
+	action string
+	name   string
+	to     string
+	value  headerTemplate
+}
+
+// headerTemplate is a header value split into literal text and ${variables}
+type headerTemplate []templatePart
+
+type templatePart struct {
+	literal  string
+	variable func(hc *headerContext) string
+}
+
+// headerContext is what header rule values are expanded from, per request
+type headerContext struct {
+	r     *http.Request
+	route *Route
+	id    string
+}
+
+// newHeaderRules compiles the top-level rules followed by the route's own.
+// Sensitive headers allowed by either are passed through
+func newHeaderRules(cfgs ...*config.DataConfigHeaderRules) (*headerRules, error) {
+	hr := &headerRules{allowSensitive: make(map[string]bool)}
+	for _, cfg := range cfgs {
+		if cfg == nil {
+			continue
+		}
+		for _, name := range cfg.AllowSensitive {
+			hr.allowSensitive[http.CanonicalHeaderKey(name)] = true
+		}
+		for _, ruleCfg := range cfg.Request {
+			rule, err := newHeaderRule(ruleCfg)
+			if err != nil {
+				return nil, err
+			}
+			hr.request = append(hr.request, rule)
+		}
+		for _, ruleCfg := range cfg.Response {
+			rule, err := newHeaderRule(ruleCfg)
+			if err != nil {
+				return nil, err
+			}
+			hr.response = append(hr.response, rule)
+		}
+	}
+	return hr, nil
+}
+
+func newHeaderRule(cfg config.DataConfigHeaderRule) (headerRule, error) {
+	value, err := parseHeaderTemplate(cfg.Value)
+	if err != nil {
+		return headerRule{}, fmt.Errorf("header %s: %w", cfg.Name, err)
+	}
+	return headerRule{
+		action: strings.ToLower(cfg.Action),
+		name:   http.CanonicalHeaderKey(cfg.Name),
+		to:     http.CanonicalHeaderKey(cfg.To),
+		value:  value,
+	}, nil
+}
+
+// parseHeaderTemplate splits a value at its ${variable} references
+func parseHeaderTemplate(value string) (headerTemplate, error) {
+	var t headerTemplate
+	for value != "" {
+		start := strings.Index(value, "${")
+		if start < 0 {
+			t = append(t, templatePart{literal: value})
+			break
+		}
+		end := strings.IndexByte(value[start:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated variable in %q", value)
+		}
+		name := value[start+2 : start+end]
+		variable, ok := headerVariables[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown variable ${%s}", name)
+		}
+		if start > 0 {
+			t = append(t, templatePart{literal: value[:start]})
+		}
+		t = append(t, templatePart{variable: variable})
+		value = value[start+end+1:]
+	}
+	return t, nil
+}
+
+// expand renders the template for a request
+func (t headerTemplate) expand(hc *headerContext) string {
+	if len(t) == 1 && t[0].variable == nil {
+		return t[0].literal
+	}
+	var b strings.Builder
+	for _, part := range t {
+		if part.variable != nil {
+			b.WriteString(part.variable(hc))
+		} else {
+			b.WriteString(part.literal)
+		}
+	}
+	// Request values such as the path must not break the header
+	return strings.Map(func(r rune) rune {
+		if r == '\r' || r == '\n' {
+			return -1
+		}
+		return r
+	}, b.String())
+}
+
+// applyHeaderRules runs the rules on a header in order
+func applyHeaderRules(rules []headerRule, h http.Header, hc *headerContext) {
+	for _, rule := range rules {
+		switch rule.action {
+		case "set":
+			h.Set(rule.name, rule.value.expand(hc))
+		case "add":
+			h.Add(rule.name, rule.value.expand(hc))
+		case "remove":
+			h.Del(rule.name)
+		case "rename":
+			if values := h.Values(rule.name); len(values) > 0 {
+				h.Del(rule.name)
+				h[rule.to] = values
+			}
+		}
+	}
+}
+
+// requestID returns the client's X-Request-ID when it looks sane, or a new
+// random one, the same for every rule of the request
+func (hc *headerContext) requestID() string {
+	if hc.id != "" {
+		return hc.id
+	}
+	if id := hc.r.Header.Get("X-Request-ID"); validRequestID(id) {
+		hc.id = id
+		return id
+	}
+	var b [16]byte
+	rand.Read(b[:])
+	hc.id = hex.EncodeToString(b[:])
+	return hc.id
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// Removes sensitive headers before forwarding, except the allowed ones
+func removeSensitiveRequestHeaders(h http.Header, allowed map[string]bool) {
+	for _, header := range sensitiveRequestHeaders {
+		if !allowed[header] {
+			h.Del(header)
+		}
+	}
+}
+
+// Removes headers that reveal server info, except the allowed ones
+func removeSensitiveResponseHeaders(h http.Header, allowed map[string]bool) {
+	for _, header := range sensitiveResponseHeaders {
+		if !allowed[header] {
+			h.Del(header)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/ezhttp/ezhttp/internal/config"
+	"github.com/ezhttp/ezhttp/internal/logger"
+)
+
+// Available reports whether requests may be sent to the origin: it passed
+// its active probes and is not passively ejected
+func (o *Origin) Available() bool {
+	if !o.healthy.Load() {
+		return false
+	}
+	until := o.ejectedUntil.Load()
+	if until == 0 {
+		return true
+	}
+	if time.Now().UnixNano() < until {
+		return false
+	}
+	// Ejection is over, only one caller logs the transition
+	if o.ejectedUntil.CompareAndSwap(until, 0) {
+		logger.Info("Upstream returned from ejection", "origin", o.URL.String())
+	}
+	return true
+}
+
+// Report records the outcome of a proxied request for passive health
+// checking and the circuit breaker. Connection errors and 5xx responses
+// count as failures; after maxFails consecutive ones the origin is ejected
+// for the eject duration
+func (p *Pool) Report(origin *Origin, success bool) {
+	origin.breaker.record(success)
+	if success {
+		origin.fails.Store(0)
+		return
+	}
+
+	origin.RecordFailure()
+	if p.maxFails <= 0 || p.ejectDuration <= 0 {
+		return
+	}
+	if origin.fails.Add(1) < p.maxFails {
+		return
+	}
+
+	origin.fails.Store(0)
+	until := time.Now().Add(p.ejectDuration).UnixNano()
+	if old := origin.ejectedUntil.Swap(until); old == 0 {
+		logger.Warn("Upstream ejected after consecutive failures",
+			"origin", origin.URL.String(),
+			"failures", p.maxFails,
+			"duration", p.ejectDuration.String())
+	}
+}
+
+// Ready reports how many origins are available
+func (p *Pool) Ready() (available int, total int) {
+	return len(p.available()), len(p.origins)
+}
+
+// HealthChecker actively probes every origin of a pool
+type HealthChecker struct {
+	pool               *Pool
+	client             *http.Client
+	path               string
+	interval           time.Duration
+	timeout            time.Duration
+	expectedStatus     int
+	healthyThreshold   int
+	unhealthyThreshold int
+}
+
+// NewHealthChecker creates an active health checker. Returns nil when no
+// probe path is configured
+func NewHealthChecker(pool *Pool, transport http.RoundTripper, cfg *config.DataConfigHealthCheck) (*HealthChecker, error) {
+	if cfg.Path == "" {
+		return nil, nil
+	}
+
+	interval, err := time.ParseDuration(cfg.Interval)
+	if err != nil || interval <= 0 {
+		return nil, fmt.Errorf("invalid health check interval: %s", cfg.Interval)
+	}
+	timeout, err := time.ParseDuration(cfg.Timeout)
+	if err != nil || timeout <= 0 {
+		return nil, fmt.Errorf("invalid health check timeout: %s", cfg.Timeout)
+	}
+
+	return &HealthChecker{
+		pool: pool,
+		client: &http.Client{
+			Transport: transport,
+			// A redirect is an answer, not something to follow
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		path:               cfg.Path,
+		interval:           interval,
+		timeout:            timeout,
+		expectedStatus:     cfg.ExpectedStatus,
+		healthyThreshold:   cfg.HealthyThreshold,
+		unhealthyThreshold: cfg.UnhealthyThreshold,
+	}, nil
+}
+
+// Start probes every origin in its own goroutine
+func (hc *HealthChecker) Start() {
+	for _, origin := range hc.pool.origins {
+		go hc.probeLoop(origin)
+	}
+}
+
+// probeLoop probes one origin every interval, flipping its state once the
+// threshold of consecutive results is reached
+func (hc *HealthChecker) probeLoop(origin *Origin) {
+	ticker := time.NewTicker(hc.interval)
+	defer ticker.Stop()
+
+	streak := 0
+	for {
+		err := hc.probe(origin)
+		healthy := origin.healthy.Load()
+
+		switch {
+		case err == nil && healthy, err != nil && !healthy:
+			streak = 0
+		case err == nil:
+			streak++
+			if streak >= hc.healthyThreshold {
+				origin.healthy.Store(true)
+				streak = 0
+				logger.Info("Upstream is healthy", "origin", origin.URL.String())
+			}
+		default:
+			streak++
+			if streak >= hc.unhealthyThreshold {
+				origin.healthy.Store(false)
+				streak = 0
+				logger.Warn("Upstream is unhealthy", "origin", origin.URL.String(), "reason", err.Error())
+			}
+		}
+
+		<-ticker.C
+	}
+}
+
+// probe requests the health check path of an origin
+func (hc *HealthChecker) probe(origin *Origin) error {
+	ctx, cancel := context.WithTimeout(context.Background(), hc.timeout)
+	defer cancel()
+
+	probeURL := *origin.URL
+	probeURL.Path = hc.path
+	probeURL.RawQuery = ""
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, probeURL.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "ezhttp-proxy-healthcheck")
+
+	resp, err := hc.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode != hc.expectedStatus {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// ReadinessMiddleware answers /ready with 200 while every pool has at least
+// one available origin and 503 otherwise. Like /health it bypasses authentication
+func ReadinessMiddleware(pools ...*Pool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/ready" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			ready := true
+			available, total := 0, 0
+			for _, pool := range pools {
+				poolAvailable, poolTotal := pool.Ready()
+				if poolAvailable == 0 {
+					ready = false
+				}
+				available += poolAvailable
+				total += poolTotal
+			}
+
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.Header().Set("Cache-Control", "no-store")
+			if !ready {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				fmt.Fprintf(w, "NOT READY %d/%d", available, total)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprintf(w, "READY %d/%d", available, total)
+		})
+	}
+}
@@ -0,0 +1,376 @@
+package proxy
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ezhttp/ezhttp/internal/config"
+	"github.com/ezhttp/ezhttp/internal/logger"
+	"github.com/ezhttp/ezhttp/internal/ratelimit"
+)
+
+// Load balancing strategies
+const (
+	StrategyRoundRobin       = "round_robin"
+	StrategyLeastConnections = "least_connections"
+	StrategyRandomTwo        = "random_two"
+	StrategyConsistentHash   = "consistent_hash"
+)
+
+// Virtual nodes per unit of weight on the consistent hash ring
+const hashRingReplicas = 100
+
+// Origin is one upstream of the pool
+type Origin struct {
+	URL    *url.URL
+	Weight int
+
+	active   atomic.Int64
+	requests atomic.Uint64
+	failures atomic.Uint64
+
+	// Smooth weighted round robin state, guarded by Pool.mu
+	currentWeight int
+
+	// Health state, see health.go
+	healthy      atomic.Bool
+	ejectedUntil atomic.Int64
+	fails        atomic.Int64
+
+	breaker *circuitBreaker
+}
+
+// OriginStats is a snapshot of an origin's counters
+type OriginStats struct {
+	URL      string
+	Weight   int
+	Active   int64
+	Requests uint64
+	Failures uint64
+	Healthy  bool
+	Ejected  bool
+	Breaker  string
+}
+
+// Pool spreads requests over several origins
+type Pool struct {
+	origins    []*Origin
+	strategy   string
+	hashHeader string
+
+	// Passive health checking
+	maxFails      int64
+	ejectDuration time.Duration
+
+	mu   sync.Mutex
+	ring []ringPoint
+}
+
+type ringPoint struct {
+	hash   uint64
+	origin *Origin
+}
+
+// NewPool creates the upstream pool from the proxy configuration. Without
+// origins, the origin base URL forms a pool of one
+func NewPool(cfg *config.DataConfigProxy) (*Pool, error) {
+	origins := cfg.Origins
+	if len(origins) == 0 {
+		if cfg.OriginBaseURL == "" {
+			return nil, fmt.Errorf("proxy origin base URL or origins are required")
+		}
+		origins = []config.DataConfigProxyOrigin{{URL: cfg.OriginBaseURL, Weight: 1}}
+	}
+
+	p := &Pool{
+		strategy:   cfg.LoadBalancing.Strategy,
+		hashHeader: cfg.LoadBalancing.HashHeader,
+		maxFails:   int64(cfg.HealthCheck.MaxFailsOrDefault()),
+	}
+	if cfg.HealthCheck.EjectDuration != "" {
+		d, err := time.ParseDuration(cfg.HealthCheck.EjectDuration)
+		if err != nil {
+			return nil, fmt.Errorf("invalid eject duration: %w", err)
+		}
+		p.ejectDuration = d
+	}
+	if p.strategy == "" {
+		p.strategy = StrategyRoundRobin
+	}
+
+	for _, o := range origins {
+		originURL, err := url.Parse(o.URL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid origin URL %s: %w", o.URL, err)
+		}
+		weight := o.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		origin := &Origin{
+			URL:     originURL,
+			Weight:  weight,
+			breaker: newCircuitBreaker(originURL.String(), &cfg.CircuitBreaker),
+		}
+		origin.healthy.Store(true)
+		p.origins = append(p.origins, origin)
+	}
+
+	if p.strategy == StrategyConsistentHash {
+		p.buildRing()
+	}
+
+	return p, nil
+}
+
+// buildRing places weighted virtual nodes of every origin on the hash ring
+func (p *Pool) buildRing() {
+	p.ring = p.ring[:0]
+	for _, origin := range p.origins {
+		for i := 0; i < origin.Weight*hashRingReplicas; i++ {
+			p.ring = append(p.ring, ringPoint{
+				hash:   hashKey(origin.URL.String() + "#" + strconv.Itoa(i)),
+				origin: origin,
+			})
+		}
+	}
+	sort.Slice(p.ring, func(i, j int) bool {
+		return p.ring[i].hash < p.ring[j].hash
+	})
+}
+
+// Origins returns the origins of the pool
+func (p *Pool) Origins() []*Origin {
+	return p.origins
+}
+
+// Pick chooses the origin for a request among the available ones, avoiding
+// the excluded ones (earlier attempts) unless nothing else is left. Returns
+// nil when every origin is unhealthy, ejected or has an open circuit
+func (p *Pool) Pick(r *http.Request, exclude ...*Origin) *Origin {
+	candidates := p.available()
+	if len(exclude) > 0 {
+		others := make([]*Origin, 0, len(candidates))
+		for _, origin := range candidates {
+			if !slices.Contains(exclude, origin) {
+				others = append(others, origin)
+			}
+		}
+		if len(others) > 0 {
+			candidates = others
+		}
+	}
+
+	// A half-open circuit may have run out of trial slots in the meantime
+	for len(candidates) > 0 {
+		origin := p.pick(r, candidates)
+		if origin == nil {
+			return nil
+		}
+		if origin.breaker.allow() {
+			return origin
+		}
+		candidates = slices.DeleteFunc(candidates, func(o *Origin) bool {
+			return o == origin
+		})
+	}
+	return nil
+}
+
+// pick applies the load balancing strategy to the candidates
+func (p *Pool) pick(r *http.Request, candidates []*Origin) *Origin {
+	if len(candidates) == 1 {
+		return candidates[0]
+	}
+
+	switch p.strategy {
+	case StrategyLeastConnections:
+		return pickLeastConnections(candidates)
+	case StrategyRandomTwo:
+		return pickRandomTwo(candidates)
+	case StrategyConsistentHash:
+		return p.pickConsistentHash(r, candidates)
+	default:
+		return p.pickRoundRobin(candidates)
+	}
+}
+
+// available returns the origins requests may be sent to
+func (p *Pool) available() []*Origin {
+	candidates := make([]*Origin, 0, len(p.origins))
+	for _, origin := range p.origins {
+		if origin.Available() && origin.breaker.ready() {
+			candidates = append(candidates, origin)
+		}
+	}
+	return candidates
+}
+
+// pickRoundRobin is nginx's smooth weighted round robin, which interleaves
+// heavier origins instead of sending them bursts
+func (p *Pool) pickRoundRobin(candidates []*Origin) *Origin {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	total := 0
+	var best *Origin
+	for _, origin := range candidates {
+		origin.currentWeight += origin.Weight
+		total += origin.Weight
+		if best == nil || origin.currentWeight > best.currentWeight {
+			best = origin
+		}
+	}
+	best.currentWeight -= total
+	return best
+}
+
+// pickLeastConnections picks the origin with the fewest active requests
+// relative to its weight. Ties start at a random origin to spread load
+func pickLeastConnections(candidates []*Origin) *Origin {
+	start := rand.IntN(len(candidates))
+	var best *Origin
+	for i := range candidates {
+		origin := candidates[(start+i)%len(candidates)]
+		if best == nil || lessLoaded(origin, best) {
+			best = origin
+		}
+	}
+	return best
+}
+
+// pickRandomTwo picks two distinct origins at random (by weight) and keeps
+// the less loaded one
+func pickRandomTwo(candidates []*Origin) *Origin {
+	first := randomWeighted(candidates, nil)
+	second := randomWeighted(candidates, first)
+	if lessLoaded(second, first) {
+		return second
+	}
+	return first
+}
+
+// randomWeighted picks a random origin by weight, skipping exclude
+func randomWeighted(candidates []*Origin, exclude *Origin) *Origin {
+	total := 0
+	for _, origin := range candidates {
+		if origin != exclude {
+			total += origin.Weight
+		}
+	}
+	n := rand.IntN(total)
+	for _, origin := range candidates {
+		if origin == exclude {
+			continue
+		}
+		if n < origin.Weight {
+			return origin
+		}
+		n -= origin.Weight
+	}
+	return candidates[len(candidates)-1]
+}
+
+// pickConsistentHash maps the client (IP or hash header) onto the ring, so
+// the same client keeps hitting the same origin while it is available.
+// Clients of an unavailable origin move to the next candidate on the ring
+func (p *Pool) pickConsistentHash(r *http.Request, candidates []*Origin) *Origin {
+	key := ""
+	if p.hashHeader != "" {
+		key = r.Header.Get(p.hashHeader)
+	}
+	if key == "" {
+		key = ratelimit.ExtractIP(r.RemoteAddr)
+	}
+
+	h := hashKey(key)
+	i := sort.Search(len(p.ring), func(i int) bool {
+		return p.ring[i].hash >= h
+	})
+	for n := 0; n < len(p.ring); n++ {
+		point := p.ring[(i+n)%len(p.ring)]
+		if slices.Contains(candidates, point.origin) {
+			return point.origin
+		}
+	}
+	return nil
+}
+
+// lessLoaded compares active requests per unit of weight
+func lessLoaded(a *Origin, b *Origin) bool {
+	return a.active.Load()*int64(b.Weight) < b.active.Load()*int64(a.Weight)
+}
+
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
+
+// Acquire marks the start of a request to the origin
+func (o *Origin) Acquire() {
+	o.active.Add(1)
+	o.requests.Add(1)
+}
+
+// Release marks the end of a request to the origin
+func (o *Origin) Release() {
+	o.active.Add(-1)
+}
+
+// RecordFailure counts a failed request to the origin
+func (o *Origin) RecordFailure() {
+	o.failures.Add(1)
+}
+
+// Stats returns a snapshot of the origin's counters
+func (o *Origin) Stats() OriginStats {
+	return OriginStats{
+		URL:      o.URL.String(),
+		Weight:   o.Weight,
+		Active:   o.active.Load(),
+		Requests: o.requests.Load(),
+		Failures: o.failures.Load(),
+		Healthy:  o.healthy.Load(),
+		Ejected:  o.ejectedUntil.Load() > time.Now().UnixNano(),
+		Breaker:  o.breaker.stateName(),
+	}
+}
+
+// Stats returns the counters of every origin
+func (p *Pool) Stats() []OriginStats {
+	stats := make([]OriginStats, 0, len(p.origins))
+	for _, origin := range p.origins {
+		stats = append(stats, origin.Stats())
+	}
+	return stats
+}
+
+// LogStats logs the per-origin counters every interval
+func (p *Pool) LogStats(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		for _, stats := range p.Stats() {
+			logger.Info("Upstream stats",
+				"origin", stats.URL,
+				"weight", stats.Weight,
+				"active", stats.Active,
+				"requests", stats.Requests,
+				"failures", stats.Failures,
+				"healthy", stats.Healthy,
+				"ejected", stats.Ejected,
+				"breaker", stats.Breaker)
+		}
+	}
+}
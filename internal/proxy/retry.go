@@ -0,0 +1,203 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ezhttp/ezhttp/internal/config"
+)
+
+// Window over which the retry budget is computed
+const retryBudgetWindow = 10 * time.Second
+
+// retryPolicy decides whether and when a failed origin request is retried
+type retryPolicy struct {
+	maxRetries   int
+	retryOn      map[int]bool
+	maxBodyBytes int64
+	backoffBase  time.Duration
+	backoffMax   time.Duration
+	budget       *retryBudget
+}
+
+// retryBudget caps retries to a share of the recent requests
+type retryBudget struct {
+	ratio        float64
+	minPerSecond int
+
+	mu          sync.Mutex
+	windowStart time.Time
+	requests    int
+	retries     int
+}
+
+// requestBody is the body of the incoming request as sent to the origin.
+// Buffered bodies can be replayed on every attempt
+type requestBody struct {
+	buffered   []byte
+	replayable bool
+	stream     io.ReadCloser
+	length     int64
+}
+
+func newRetryPolicy(cfg *config.DataConfigRetry) *retryPolicy {
+	rp := &retryPolicy{
+		maxRetries:   cfg.MaxRetriesOrDefault(),
+		retryOn:      make(map[int]bool),
+		maxBodyBytes: cfg.MaxBodyBytes,
+		backoffBase:  50 * time.Millisecond,
+		backoffMax:   time.Second,
+		budget: &retryBudget{
+			ratio:        cfg.BudgetRatio,
+			minPerSecond: cfg.BudgetMinPerSecond,
+			windowStart:  time.Now(),
+		},
+	}
+	for _, status := range cfg.RetryOn {
+		rp.retryOn[status] = true
+	}
+	if d, err := time.ParseDuration(cfg.BackoffBase); err == nil {
+		rp.backoffBase = d
+	}
+	if d, err := time.ParseDuration(cfg.BackoffMax); err == nil {
+		rp.backoffMax = d
+	}
+	return rp
+}
+
+// readBody buffers a body of up to maxBodyBytes so failed attempts can be
+// replayed. Larger bodies are streamed once and never retried
+func (rp *retryPolicy) readBody(r *http.Request) (*requestBody, error) {
+	body := &requestBody{stream: r.Body, length: r.ContentLength}
+	if rp.maxRetries == 0 || r.Body == nil || r.Body == http.NoBody {
+		body.replayable = r.Body == nil || r.Body == http.NoBody
+		return body, nil
+	}
+	if r.ContentLength > rp.maxBodyBytes {
+		return body, nil
+	}
+
+	buffered, err := io.ReadAll(io.LimitReader(r.Body, rp.maxBodyBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(buffered)) > rp.maxBodyBytes {
+		// Too large after all, send what was read followed by the rest
+		body.stream = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(buffered), r.Body), r.Body}
+		return body, nil
+	}
+
+	body.buffered = buffered
+	body.replayable = true
+	body.length = int64(len(buffered))
+	return body, nil
+}
+
+// reader returns the body for the next attempt
+func (b *requestBody) reader() io.ReadCloser {
+	if !b.replayable {
+		return b.stream
+	}
+	if len(b.buffered) == 0 {
+		return http.NoBody
+	}
+	return io.NopCloser(bytes.NewReader(b.buffered))
+}
+
+// isIdempotent reports whether the request can safely be sent twice
+func isIdempotent(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return r.Header.Get("Idempotency-Key") != "" || r.Header.Get("X-Idempotency-Key") != ""
+}
+
+// isDialError reports whether the request failed before reaching the origin
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// retryReason returns why the attempt should be retried, "" when it must
+// not be. The caller still checks the budget and the remaining origins
+func (rp *retryPolicy) retryReason(r *http.Request, body *requestBody, attempt int, resp *http.Response, err error) string {
+	if attempt > rp.maxRetries || !body.replayable {
+		return ""
+	}
+	if err != nil {
+		if isDialError(err) {
+			return "connect failed"
+		}
+		if isIdempotent(r) && !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
+			return "request failed"
+		}
+		return ""
+	}
+	if isIdempotent(r) && rp.retryOn[resp.StatusCode] {
+		return fmt.Sprintf("status %d", resp.StatusCode)
+	}
+	return ""
+}
+
+// backoff waits a random time up to the exponential backoff of the attempt
+func (rp *retryPolicy) backoff(ctx context.Context, attempt int) error {
+	limit := rp.backoffBase << (attempt - 1)
+	if limit > rp.backoffMax || limit <= 0 {
+		limit = rp.backoffMax
+	}
+	if limit <= 0 {
+		return ctx.Err()
+	}
+
+	timer := time.NewTimer(rand.N(limit))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// roll starts a new budget window when the current one is over
+func (b *retryBudget) roll(now time.Time) {
+	if now.Sub(b.windowStart) >= retryBudgetWindow {
+		b.windowStart = now
+		b.requests = 0
+		b.retries = 0
+	}
+}
+
+// request counts a proxied request towards the budget
+func (b *retryBudget) request() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.roll(time.Now())
+	b.requests++
+}
+
+// withdraw takes a retry from the budget, false when it is exhausted
+func (b *retryBudget) withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.roll(time.Now())
+
+	allowed := float64(b.minPerSecond)*retryBudgetWindow.Seconds() + b.ratio*float64(b.requests)
+	if float64(b.retries) >= allowed {
+		return false
+	}
+	b.retries++
+	return true
+}
@@ -0,0 +1,308 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ezhttp/ezhttp/internal/config"
+)
+
+// Route sends matching requests to a pool of origins
+type Route struct {
+	Name string
+	Pool *Pool
+
+	host        string // lowercase, "" = any host
+	prefix      string // without trailing slash, "/" = everything
+	stripPrefix bool
+	addPrefix   string
+
+	timeout        time.Duration // whole request, 0 = no limit
+	headerTimeout  time.Duration // per attempt until the response headers
+	writeTimeout   time.Duration
+	allowedMethods map[string]bool // nil = AllowedMethods
+	maxRequestSize int64           // 0 = global limit
+	requireAuth    *bool           // nil = global setting
+	headers        *headerRules
+	cookies        *cookiePolicy
+}
+
+// Router picks the route for a request
+type Router struct {
+	routes []*Route // most specific first
+	pools  []*Pool
+}
+
+type routeContextKey struct{}
+
+// NewRouter builds the routes of the proxy configuration. The top-level
+// origins form a catch-all route after the configured ones
+func NewRouter(cfg *config.DataConfigProxy) (*Router, error) {
+	rt := &Router{}
+
+	// Route timeouts default to the top-level ones
+	requestTimeout, err := parseOptionalDuration(cfg.RequestTimeout, 0)
+	if err != nil {
+		return nil, fmt.Errorf("invalid request timeout: %w", err)
+	}
+	headerTimeout, err := parseOptionalDuration(cfg.ResponseHeaderTimeout, 0)
+	if err != nil {
+		return nil, fmt.Errorf("invalid response header timeout: %w", err)
+	}
+
+	defaultHeaders, err := newHeaderRules(&cfg.Headers)
+	if err != nil {
+		return nil, fmt.Errorf("invalid header rules: %w", err)
+	}
+
+	defaultCookies := newCookiePolicy(&cfg.Cookies)
+
+	var defaultPool *Pool
+	if cfg.OriginBaseURL != "" || len(cfg.Origins) > 0 {
+		pool, err := NewPool(cfg)
+		if err != nil {
+			return nil, err
+		}
+		defaultPool = pool
+		rt.pools = append(rt.pools, pool)
+	}
+
+	for i, routeCfg := range cfg.Routes {
+		route := &Route{
+			Name:        routeCfg.Name,
+			host:        strings.ToLower(routeCfg.Host),
+			prefix:      normalizePrefix(routeCfg.Prefix),
+			stripPrefix: routeCfg.StripPrefix,
+			addPrefix:   strings.TrimSuffix(routeCfg.AddPrefix, "/"),
+			Pool:        defaultPool,
+
+			maxRequestSize: routeCfg.MaxRequestSize,
+			requireAuth:    routeCfg.RequireAuth,
+			cookies:        defaultCookies,
+		}
+		if routeCfg.Cookies != nil {
+			route.cookies = newCookiePolicy(routeCfg.Cookies)
+		}
+		if route.Name == "" {
+			route.Name = fmt.Sprintf("route%d", i)
+		}
+
+		if len(routeCfg.Origins) > 0 {
+			// Same load balancing and health settings as the top-level pool
+			poolCfg := *cfg
+			poolCfg.Origins = routeCfg.Origins
+			pool, err := NewPool(&poolCfg)
+			if err != nil {
+				return nil, fmt.Errorf("route %s: %w", route.Name, err)
+			}
+			route.Pool = pool
+			rt.pools = append(rt.pools, pool)
+		}
+		if route.Pool == nil {
+			return nil, fmt.Errorf("route %s has no origins", route.Name)
+		}
+
+		if route.timeout, err = parseOptionalDuration(routeCfg.Timeout, requestTimeout); err != nil {
+			return nil, fmt.Errorf("route %s: invalid timeout: %w", route.Name, err)
+		}
+		if route.headerTimeout, err = parseOptionalDuration(routeCfg.ResponseHeaderTimeout, headerTimeout); err != nil {
+			return nil, fmt.Errorf("route %s: invalid response header timeout: %w", route.Name, err)
+		}
+		if route.writeTimeout, err = parseOptionalDuration(routeCfg.WriteTimeout, 0); err != nil {
+			return nil, fmt.Errorf("route %s: invalid write timeout: %w", route.Name, err)
+		}
+		if route.headers, err = newHeaderRules(&cfg.Headers, &routeCfg.Headers); err != nil {
+			return nil, fmt.Errorf("route %s: invalid header rules: %w", route.Name, err)
+		}
+		if len(routeCfg.AllowedMethods) > 0 {
+			route.allowedMethods = make(map[string]bool)
+			for _, method := range routeCfg.AllowedMethods {
+				route.allowedMethods[method] = true
+			}
+		}
+
+		rt.routes = append(rt.routes, route)
+	}
+
+	// Host routes before host-less ones, then longer prefixes first
+	sort.SliceStable(rt.routes, func(i, j int) bool {
+		a, b := rt.routes[i], rt.routes[j]
+		if (a.host != "") != (b.host != "") {
+			return a.host != ""
+		}
+		return len(a.prefix) > len(b.prefix)
+	})
+
+	if defaultPool != nil {
+		rt.routes = append(rt.routes, &Route{
+			Name:          "default",
+			prefix:        "/",
+			Pool:          defaultPool,
+			timeout:       requestTimeout,
+			headerTimeout: headerTimeout,
+			headers:       defaultHeaders,
+			cookies:       defaultCookies,
+		})
+	}
+	if len(rt.routes) == 0 {
+		return nil, fmt.Errorf("proxy origin base URL, origins or routes are required")
+	}
+
+	return rt, nil
+}
+
+// parseOptionalDuration parses value, returning fallback when it is empty
+func parseOptionalDuration(value string, fallback time.Duration) (time.Duration, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	return time.ParseDuration(value)
+}
+
+// normalizePrefix removes the trailing slash so "/api/" also matches "/api"
+func normalizePrefix(prefix string) string {
+	if prefix == "/" || prefix == "" {
+		return "/"
+	}
+	return strings.TrimSuffix(prefix, "/")
+}
+
+// Routes returns the routes in match order
+func (rt *Router) Routes() []*Route {
+	return rt.routes
+}
+
+// Pools returns every upstream pool, for health checks and stats
+func (rt *Router) Pools() []*Pool {
+	return rt.pools
+}
+
+// Match returns the route for the request or nil
+func (rt *Router) Match(r *http.Request) *Route {
+	host := strings.ToLower(r.Host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	for _, route := range rt.routes {
+		if route.matchesHost(host) && route.matchesPath(r.URL.Path) {
+			return route
+		}
+	}
+	return nil
+}
+
+func (route *Route) matchesHost(host string) bool {
+	if route.host == "" {
+		return true
+	}
+	if suffix, found := strings.CutPrefix(route.host, "*"); found {
+		return strings.HasSuffix(host, suffix) && len(host) > len(suffix)
+	}
+	return host == route.host
+}
+
+func (route *Route) matchesPath(path string) bool {
+	return route.prefix == "/" || path == route.prefix || strings.HasPrefix(path, route.prefix+"/")
+}
+
+// RewritePath maps the request path to the origin path
+func (route *Route) RewritePath(path string) string {
+	if route.stripPrefix && route.prefix != "/" {
+		path = strings.TrimPrefix(path, route.prefix)
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+	}
+	if route.addPrefix != "" {
+		path = route.addPrefix + path
+	}
+	return path
+}
+
+// PublicPath maps an origin path back to the path clients use, the reverse
+// of RewritePath. Paths outside the added prefix map to the whole route
+func (route *Route) PublicPath(path string) string {
+	if route.addPrefix != "" {
+		trimmed, ok := strings.CutPrefix(path, route.addPrefix)
+		if !ok || (trimmed != "" && !strings.HasPrefix(trimmed, "/")) {
+			trimmed = "/"
+		}
+		path = trimmed
+		if path == "" {
+			path = "/"
+		}
+	}
+	if route.stripPrefix && route.prefix != "/" {
+		if path == "/" {
+			return route.prefix
+		}
+		path = route.prefix + path
+	}
+	return path
+}
+
+// Timeout returns the route's request timeout, 0 when unset
+func (route *Route) Timeout() time.Duration {
+	return route.timeout
+}
+
+// ResponseHeaderTimeout returns how long each attempt may wait for the
+// response headers, 0 when unset
+func (route *Route) ResponseHeaderTimeout() time.Duration {
+	return route.headerTimeout
+}
+
+// WriteTimeout returns the route's write deadline extension, 0 when unset
+func (route *Route) WriteTimeout() time.Duration {
+	return route.writeTimeout
+}
+
+// MethodAllowed reports whether the route accepts the method
+func (route *Route) MethodAllowed(method string) bool {
+	if route.allowedMethods == nil {
+		return AllowedMethods[method]
+	}
+	return route.allowedMethods[method]
+}
+
+// MaxRequestSize returns the route's body limit, or fallback when unset
+func (route *Route) MaxRequestSize(fallback int64) int64 {
+	if route.maxRequestSize > 0 {
+		return route.maxRequestSize
+	}
+	return fallback
+}
+
+// RequiresAuth reports whether the auth token is checked, given whether a
+// token is configured at all
+func (route *Route) RequiresAuth(configured bool) bool {
+	if route.requireAuth == nil {
+		return configured
+	}
+	return *route.requireAuth && configured
+}
+
+// RouteMiddleware resolves the route once and stores it in the request
+// context for the validation, auth and proxy handlers
+func RouteMiddleware(rt *Router) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if route := rt.Match(r); route != nil {
+				r = r.WithContext(context.WithValue(r.Context(), routeContextKey{}, route))
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RouteFromContext returns the route resolved by RouteMiddleware, or nil
+func RouteFromContext(ctx context.Context) *Route {
+	route, _ := ctx.Value(routeContextKey{}).(*Route)
+	return route
+}
@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"time"
+
+	"github.com/ezhttp/ezhttp/internal/logger"
+)
+
+// isStreamingResponse reports whether the response must reach the client as
+// it arrives: Server-Sent Events, or a body of unknown length (chunked) that
+// the transport did not decompress itself
+func isStreamingResponse(r *http.Request, resp *http.Response) bool {
+	if r.Method == http.MethodHead || resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified {
+		return false
+	}
+	if mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type")); err == nil && mediaType == "text/event-stream" {
+		return true
+	}
+	return resp.ContentLength < 0 && !resp.Uncompressed
+}
+
+// extendDeadlines pushes the connection's read and write deadlines d into
+// the future. The server's fixed timeouts would otherwise cut long-polling
+// and streamed responses, and an expired read deadline cancels the request
+// context
+func extendDeadlines(rc *http.ResponseController, d time.Duration) {
+	deadline := time.Now().Add(d)
+	if err := rc.SetReadDeadline(deadline); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		logger.Debug("Failed to extend read deadline", "error", err)
+	}
+	if err := rc.SetWriteDeadline(deadline); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		logger.Debug("Failed to extend write deadline", "error", err)
+	}
+}
+
+// copyStreaming copies the body and flushes after every read, so events
+// are not held back in buffers. Each write gets writeTimeout to complete
+func copyStreaming(rc *http.ResponseController, w io.Writer, body io.Reader, writeTimeout time.Duration) (int64, error) {
+	// The request was read; from now on the client may stay silent. A
+	// disconnect still ends the background read and cancels the request
+	rc.SetReadDeadline(time.Time{})
+
+	buf := make([]byte, 32*1024)
+	var written int64
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			rc.SetWriteDeadline(time.Now().Add(writeTimeout))
+			nw, writeErr := w.Write(buf[:n])
+			written += int64(nw)
+			if writeErr != nil {
+				return written, writeErr
+			}
+			if flushErr := rc.Flush(); flushErr != nil {
+				return written, flushErr
+			}
+		}
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
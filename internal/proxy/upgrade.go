@@ -0,0 +1,342 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ezhttp/ezhttp/internal/config"
+	"github.com/ezhttp/ezhttp/internal/logger"
+	"github.com/ezhttp/ezhttp/internal/ratelimit"
+)
+
+// upgradeProxy tunnels HTTP Upgrade requests (WebSockets) to the origin
+type upgradeProxy struct {
+	protocols        map[string]bool // lowercase
+	idleTimeout      time.Duration
+	dialer           *net.Dialer
+	tlsConfig        *tls.Config
+	handshakeTimeout time.Duration
+
+	mu       sync.Mutex
+	open     int
+	openByIP map[string]int
+	maxOpen  int
+	maxPerIP int
+}
+
+// newUpgradeProxy creates the upgrade tunnel settings. Origin connections
+// use the same dialer, TLS configuration and handshake timeout as the
+// transport
+func newUpgradeProxy(cfg *config.DataConfigUpgrade, dialer *net.Dialer, tlsConfig *tls.Config, handshakeTimeout time.Duration) *upgradeProxy {
+	u := &upgradeProxy{
+		protocols:        make(map[string]bool),
+		idleTimeout:      5 * time.Minute,
+		dialer:           dialer,
+		tlsConfig:        tlsConfig,
+		handshakeTimeout: handshakeTimeout,
+		openByIP:         make(map[string]int),
+		maxOpen:          cfg.MaxConnectionsOrDefault(),
+		maxPerIP:         cfg.MaxConnectionsPerIPOrDefault(),
+	}
+	for _, protocol := range cfg.Protocols {
+		u.protocols[strings.ToLower(protocol)] = true
+	}
+	if cfg.IdleTimeout != "" {
+		if d, err := time.ParseDuration(cfg.IdleTimeout); err == nil && d > 0 {
+			u.idleTimeout = d
+		}
+	}
+	return u
+}
+
+// protocol returns the requested Upgrade protocol when the request asks for
+// an allowed upgrade, "" otherwise. Requests for other protocols are proxied
+// as plain requests, which is how a server ignoring Upgrade behaves
+func (u *upgradeProxy) protocol(r *http.Request) string {
+	if r.ProtoMajor != 1 || !headerContainsToken(r.Header, "Connection", "upgrade") {
+		return ""
+	}
+	protocol := strings.TrimSpace(r.Header.Get("Upgrade"))
+	// A client may offer several protocols, the first allowed one is used
+	for _, offered := range strings.Split(protocol, ",") {
+		offered = strings.TrimSpace(offered)
+		name, _, _ := strings.Cut(offered, "/")
+		if u.protocols[strings.ToLower(name)] {
+			return offered
+		}
+	}
+	return ""
+}
+
+// headerContainsToken reports whether a comma-separated header has the token
+func headerContainsToken(h http.Header, name string, token string) bool {
+	for _, value := range h.Values(name) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// acquire reserves a connection slot for the client
+func (u *upgradeProxy) acquire(ip string) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.maxOpen > 0 && u.open >= u.maxOpen {
+		return false
+	}
+	if u.maxPerIP > 0 && u.openByIP[ip] >= u.maxPerIP {
+		return false
+	}
+	u.open++
+	u.openByIP[ip]++
+	return true
+}
+
+// release frees a connection slot of the client
+func (u *upgradeProxy) release(ip string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.open--
+	if u.openByIP[ip]--; u.openByIP[ip] <= 0 {
+		delete(u.openByIP, ip)
+	}
+}
+
+// dial opens a connection to the origin, with TLS for https origins
+func (u *upgradeProxy) dial(ctx context.Context, target *url.URL) (net.Conn, error) {
+	port := target.Port()
+	if port == "" {
+		port = "80"
+		if target.Scheme == "https" {
+			port = "443"
+		}
+	}
+
+	conn, err := u.dialer.DialContext(ctx, "tcp", net.JoinHostPort(target.Hostname(), port))
+	if err != nil {
+		return nil, err
+	}
+	if target.Scheme != "https" {
+		return conn, nil
+	}
+
+	tlsConfig := u.tlsConfig.Clone()
+	tlsConfig.ServerName = target.Hostname()
+	// Upgrade is HTTP/1.1 only
+	tlsConfig.NextProtos = []string{"http/1.1"}
+	tlsConn := tls.Client(conn, tlsConfig)
+	if u.handshakeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, u.handshakeTimeout)
+		defer cancel()
+	}
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// serveUpgrade sends the upgrade request to the origin and, once it switches
+// protocols, hijacks the client connection and pipes both ways. A refusal
+// from the origin is relayed as a normal response
+func (h *Handler) serveUpgrade(w http.ResponseWriter, r *http.Request, proxyReq *http.Request, protocol string, hc *headerContext, origin *Origin) {
+	route := hc.route
+	clientIP := ratelimit.ExtractIP(r.RemoteAddr)
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		logger.Error("Connection upgrade not supported by response writer", "ip", clientIP)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	if !h.upgrade.acquire(clientIP) {
+		logger.Warn("Upgrade connection limit reached", "protocol", protocol, "ip", clientIP)
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	defer h.upgrade.release(clientIP)
+
+	// The hop-by-hop headers were removed, ask the origin for the upgrade
+	proxyReq.Header.Set("Connection", "Upgrade")
+	proxyReq.Header.Set("Upgrade", protocol)
+
+	originConn, err := h.upgrade.dial(proxyReq.Context(), proxyReq.URL)
+	if err != nil {
+		status := gatewayStatus(err)
+		logger.Error("Backend upgrade connection failed", "error", err, "url", proxyReq.URL.String(), "status", status)
+		route.Pool.Report(origin, false)
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	defer originConn.Close()
+
+	// The handshake is bounded by the route's response header timeout,
+	// its request timeout or the idle timeout
+	timeout := route.ResponseHeaderTimeout()
+	if timeout <= 0 {
+		timeout = route.Timeout()
+	}
+	if timeout <= 0 {
+		timeout = h.upgrade.idleTimeout
+	}
+	originConn.SetDeadline(time.Now().Add(timeout))
+
+	if err := proxyReq.Write(originConn); err != nil {
+		logger.Error("Backend upgrade request failed", "error", err, "url", proxyReq.URL.String())
+		route.Pool.Report(origin, false)
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+	originReader := bufio.NewReader(originConn)
+	resp, err := http.ReadResponse(originReader, proxyReq)
+	if err != nil {
+		status := gatewayStatus(err)
+		logger.Error("Backend upgrade response failed", "error", err, "url", proxyReq.URL.String(), "status", status)
+		route.Pool.Report(origin, false)
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	defer resp.Body.Close()
+	route.Pool.Report(origin, resp.StatusCode < 500)
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		responseHeaders := w.Header()
+		for k, vv := range resp.Header {
+			responseHeaders[k] = vv
+		}
+		removeHopByHopHeaders(responseHeaders)
+		removeSensitiveResponseHeaders(responseHeaders, route.headers.allowSensitive)
+		route.cookies.rewriteSetCookies(responseHeaders, r, route)
+		applyHeaderRules(route.headers.response, responseHeaders, hc)
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+
+		logger.Info("Proxy request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"route", route.Name,
+			"target", proxyReq.URL.String(),
+			"status", resp.StatusCode,
+			"ip", clientIP)
+		return
+	}
+
+	switched := resp.Header.Get("Upgrade")
+	if !headerContainsToken(resp.Header, "Connection", "upgrade") || !strings.EqualFold(switched, protocol) {
+		logger.Warn("Backend switched to an unexpected protocol", "requested", protocol, "upgrade", switched, "url", proxyReq.URL.String())
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+
+	clientConn, clientBuf, err := hijacker.Hijack()
+	if err != nil {
+		logger.Error("Failed to hijack client connection", "error", err, "ip", clientIP)
+		return
+	}
+	defer clientConn.Close()
+
+	// Relay the 101 with the end-to-end headers (e.g. Sec-WebSocket-Accept)
+	responseHeaders := resp.Header.Clone()
+	removeHopByHopHeaders(responseHeaders)
+	removeSensitiveResponseHeaders(responseHeaders, route.headers.allowSensitive)
+	route.cookies.rewriteSetCookies(responseHeaders, r, route)
+	applyHeaderRules(route.headers.response, responseHeaders, hc)
+	responseHeaders.Set("Connection", "Upgrade")
+	responseHeaders.Set("Upgrade", switched)
+
+	clientConn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	clientBuf.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	responseHeaders.Write(clientBuf)
+	clientBuf.WriteString("\r\n")
+	if err := clientBuf.Flush(); err != nil {
+		logger.Warn("Failed to send upgrade response", "error", err, "ip", clientIP)
+		return
+	}
+
+	logger.Info("Upgraded proxy connection",
+		"protocol", protocol,
+		"route", route.Name,
+		"target", proxyReq.URL.String(),
+		"ip", clientIP)
+
+	start := time.Now()
+	sent, received := pipe(clientConn, clientBuf.Reader, originConn, originReader, h.upgrade.idleTimeout)
+
+	logger.Info("Upgraded proxy connection closed",
+		"protocol", protocol,
+		"route", route.Name,
+		"duration", time.Since(start).Round(time.Millisecond).String(),
+		"sent", sent,
+		"received", received,
+		"ip", clientIP)
+}
+
+// pipe copies between the client and the origin until either side closes or
+// nothing was transferred in either direction for idleTimeout. The readers
+// hold data already buffered from the connections. Returns the bytes sent to
+// and received from the origin
+func pipe(client net.Conn, clientReader io.Reader, origin net.Conn, originReader io.Reader, idleTimeout time.Duration) (sent int64, received int64) {
+	// Clear the deadlines of the server and the handshake
+	client.SetDeadline(time.Time{})
+	origin.SetDeadline(time.Time{})
+
+	var closeOnce sync.Once
+	closeBoth := func() {
+		closeOnce.Do(func() {
+			client.Close()
+			origin.Close()
+		})
+	}
+	idle := time.AfterFunc(idleTimeout, closeBoth)
+	defer idle.Stop()
+
+	done := make(chan struct{}, 2)
+	go func() {
+		sent = copyActive(origin, clientReader, idle, idleTimeout)
+		closeBoth()
+		done <- struct{}{}
+	}()
+	go func() {
+		received = copyActive(client, originReader, idle, idleTimeout)
+		closeBoth()
+		done <- struct{}{}
+	}()
+	<-done
+	<-done
+	return sent, received
+}
+
+// copyActive copies src to dst, pushing back the idle timer on every read
+func copyActive(dst io.Writer, src io.Reader, idle *time.Timer, idleTimeout time.Duration) int64 {
+	buf := make([]byte, 32*1024)
+	var written int64
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			idle.Reset(idleTimeout)
+			w, writeErr := dst.Write(buf[:n])
+			written += int64(w)
+			if writeErr != nil {
+				return written
+			}
+		}
+		if err != nil {
+			return written
+		}
+	}
+}
@@ -28,8 +28,16 @@ func RequestValidationMiddleware(allowedHost string, maxRequestSize int64) func(
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			ip := ratelimit.ExtractIP(r.RemoteAddr)
 
+			// Routes can narrow the methods and change the size limit
+			methodAllowed := AllowedMethods[r.Method]
+			maxSize := maxRequestSize
+			if route := RouteFromContext(r.Context()); route != nil {
+				methodAllowed = route.MethodAllowed(r.Method)
+				maxSize = route.MaxRequestSize(maxRequestSize)
+			}
+
 			// Validate HTTP method
-			if !AllowedMethods[r.Method] {
+			if !methodAllowed {
 				logger.Warn("Invalid HTTP method", "method", r.Method, "ip", ip)
 				http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
 				return
@@ -63,14 +71,14 @@ func RequestValidationMiddleware(allowedHost string, maxRequestSize int64) func(
 			}
 
 			// Check request size from Content-Length header
-			if r.ContentLength > 0 && r.ContentLength > maxRequestSize {
-				logger.Warn("Request too large", "size", r.ContentLength, "max", maxRequestSize, "ip", ip)
+			if r.ContentLength > 0 && r.ContentLength > maxSize {
+				logger.Warn("Request too large", "size", r.ContentLength, "max", maxSize, "ip", ip)
 				http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
 				return
 			}
 
 			// Limit request body size
-			r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+			r.Body = http.MaxBytesReader(w, r.Body, maxSize)
 
 			next.ServeHTTP(w, r)
 		})
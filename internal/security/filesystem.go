@@ -23,6 +23,7 @@ var AllowedExtensions = map[string]bool{
 	".gif":         true,
 	".svg":         true,
 	".webp":        true,
+	".avif":        true,
 	".woff":        true,
 	".woff2":       true,
 	".ttf":         true,
@@ -42,6 +43,10 @@ var AllowedExtensions = map[string]bool{
 type SecureFileSystem struct {
 	Fs      http.FileSystem
 	BaseDir string // Base directory for relative path validation
+
+	// Directories below these prefixes (e.g. "/artifacts/") may be opened
+	// for listing. Everywhere else directories are never returned
+	ListPrefixes []string
 }
 
 // Open implements http.FileSystem with security validations
@@ -87,7 +92,10 @@ func (sfs *SecureFileSystem) Open(name string) (http.File, error) {
 			// Redirect to index.html
 			return sfs.Fs.Open(indexPath)
 		}
-		// No index.html, deny directory listing
+		// No index.html, deny directory listing unless opted in
+		if sfs.listable(cleanPath) {
+			return file, nil
+		}
 		file.Close()
 		return nil, os.ErrNotExist
 	}
@@ -107,3 +115,13 @@ func (sfs *SecureFileSystem) Open(name string) (http.File, error) {
 
 	return file, nil
 }
+
+// listable reports whether the directory is below a listing prefix
+func (sfs *SecureFileSystem) listable(cleanPath string) bool {
+	for _, prefix := range sfs.ListPrefixes {
+		if strings.HasPrefix(cleanPath+"/", prefix) {
+			return true
+		}
+	}
+	return false
+}
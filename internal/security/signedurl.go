@@ -0,0 +1,113 @@
+package security
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Query parameters used by signed URLs
+const (
+	SignedURLExpiresParam   = "expires"
+	SignedURLIPParam        = "ip"
+	SignedURLSignatureParam = "signature"
+)
+
+var (
+	ErrSignatureMissing = errors.New("signature missing")
+	ErrSignatureInvalid = errors.New("signature invalid")
+	ErrSignatureExpired = errors.New("signature expired")
+	ErrSignatureNoIP    = errors.New("signature must be bound to a client IP")
+)
+
+// URLSigner signs and verifies expiring URLs below a path prefix
+type URLSigner struct {
+	Prefix string
+	secret []byte
+	bindIP bool
+}
+
+// NewURLSigner creates a signer for the prefix. With bindIP set, only links
+// bound to a client IP are accepted
+func NewURLSigner(prefix string, secret string, bindIP bool) *URLSigner {
+	return &URLSigner{
+		// "/media/" and "/media" protect the same paths, including "/media" itself
+		Prefix: strings.TrimSuffix(prefix, "/"),
+		secret: []byte(secret),
+		bindIP: bindIP,
+	}
+}
+
+// Matches reports whether the path is protected by this signer. Prefixes
+// match whole path segments, the root prefix matches every path
+func (s *URLSigner) Matches(path string) bool {
+	return path == s.Prefix || strings.HasPrefix(path, s.Prefix+"/")
+}
+
+// Sign returns the query string granting access to path until expires.
+// A non-empty ip binds the link to that client IP
+func (s *URLSigner) Sign(path string, expires time.Time, ip string) string {
+	query := url.Values{}
+	expiresStr := strconv.FormatInt(expires.Unix(), 10)
+	query.Set(SignedURLExpiresParam, expiresStr)
+	if ip != "" {
+		query.Set(SignedURLIPParam, "1")
+	}
+	query.Set(SignedURLSignatureParam, s.signature(path, expiresStr, ip))
+	return query.Encode()
+}
+
+// Verify checks the signature on a request for path made from clientIP
+func (s *URLSigner) Verify(path string, query url.Values, clientIP string) error {
+	sig := query.Get(SignedURLSignatureParam)
+	expiresStr := query.Get(SignedURLExpiresParam)
+	if sig == "" || expiresStr == "" {
+		return ErrSignatureMissing
+	}
+
+	ip := ""
+	if query.Get(SignedURLIPParam) == "1" {
+		ip = clientIP
+	} else if s.bindIP {
+		return ErrSignatureNoIP
+	}
+
+	expected := s.signature(path, expiresStr, ip)
+	if !hmac.Equal([]byte(sig), []byte(expected)) {
+		return ErrSignatureInvalid
+	}
+
+	// Only trust the expiry once the signature is known to be valid
+	expires, err := strconv.ParseInt(expiresStr, 10, 64)
+	if err != nil {
+		return ErrSignatureInvalid
+	}
+	if time.Now().Unix() > expires {
+		return ErrSignatureExpired
+	}
+
+	return nil
+}
+
+// signature computes the HMAC over path, expiry and optional client IP
+func (s *URLSigner) signature(path string, expires string, ip string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(path + "\n" + expires + "\n" + ip))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// MatchURLSigner returns the signer with the longest prefix matching path
+func MatchURLSigner(signers []*URLSigner, path string) *URLSigner {
+	var best *URLSigner
+	for _, signer := range signers {
+		if signer.Matches(path) && (best == nil || len(signer.Prefix) > len(best.Prefix)) {
+			best = signer
+		}
+	}
+	return best
+}
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ezhttp/ezhttp/internal/config"
+	"github.com/ezhttp/ezhttp/internal/logger"
+)
+
+// ABVariant is one named index template of an A/B test
+type ABVariant struct {
+	Name       string
+	Weight     int
+	Index      []string // nil = the site's regular index
+	EarlyHints []EarlyHint
+}
+
+// ABTest assigns users to index variants by weight and keeps them there
+// with a signed cookie
+type ABTest struct {
+	variants    []*ABVariant
+	byName      map[string]*ABVariant
+	totalWeight int
+	secret      []byte
+	cookie      string
+	cookieAge   time.Duration
+	queryParam  string
+	header      string
+}
+
+// NewABTest loads the variant templates. Returns nil when no variants are configured
+func NewABTest(cfg *config.DataConfigIndexVariants, rootDir string, placeholder string, sri *config.DataConfigSri, manifest *Manifest, earlyHints bool) (*ABTest, error) {
+	if len(cfg.Variants) == 0 {
+		return nil, nil
+	}
+
+	cookieAge, err := time.ParseDuration(cfg.CookieMaxAge)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cookie max age: %w", err)
+	}
+
+	t := &ABTest{
+		byName:     make(map[string]*ABVariant),
+		secret:     []byte(cfg.Secret),
+		cookie:     cfg.Cookie,
+		cookieAge:  cookieAge,
+		queryParam: cfg.QueryParam,
+		header:     cfg.Header,
+	}
+	if len(t.secret) == 0 {
+		t.secret = make([]byte, 32)
+		if _, err := rand.Read(t.secret); err != nil {
+			return nil, fmt.Errorf("failed to generate variant secret: %w", err)
+		}
+		logger.Warn("No index variant secret configured, assignments reset on restart and differ between instances")
+	}
+
+	for _, v := range cfg.Variants {
+		variant := &ABVariant{Name: v.Name, Weight: v.Weight}
+		if v.IndexFile != "" {
+			variant.Index, err = LoadIndexCache(rootDir, v.IndexFile, placeholder, sri, manifest)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load index variant %s: %w", v.Name, err)
+			}
+			if earlyHints {
+				variant.EarlyHints = ExtractEarlyHints(strings.Join(variant.Index, placeholder), placeholder)
+			}
+		}
+		t.variants = append(t.variants, variant)
+		t.byName[variant.Name] = variant
+		t.totalWeight += variant.Weight
+	}
+
+	return t, nil
+}
+
+// Variants returns the number of configured variants
+func (t *ABTest) Variants() int {
+	return len(t.variants)
+}
+
+// Select returns the variant for the request. A known variant in the query
+// parameter wins and becomes sticky, then a validly signed cookie for a
+// variant that still has weight, then a weighted random pick. The cookie,
+// Vary and variant header are set on w
+func (t *ABTest) Select(w http.ResponseWriter, r *http.Request) *ABVariant {
+	w.Header().Add("Vary", "Cookie")
+
+	variant, sticky := t.choose(r)
+	if !sticky {
+		http.SetCookie(w, &http.Cookie{
+			Name:     t.cookie,
+			Value:    variant.Name + "." + t.sign(variant.Name),
+			Path:     "/",
+			MaxAge:   int(t.cookieAge.Seconds()),
+			HttpOnly: true,
+			Secure:   r.TLS != nil,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+	if t.header != "" {
+		w.Header().Set(t.header, variant.Name)
+	}
+	return variant
+}
+
+// choose picks the variant and reports whether it came from a valid cookie
+func (t *ABTest) choose(r *http.Request) (*ABVariant, bool) {
+	if t.queryParam != "" {
+		if variant, found := t.byName[r.URL.Query().Get(t.queryParam)]; found {
+			return variant, false
+		}
+	}
+
+	if cookie, err := r.Cookie(t.cookie); err == nil {
+		name, signature, _ := strings.Cut(cookie.Value, ".")
+		// Variants rolled back to weight 0 release their users
+		if variant, found := t.byName[name]; found && variant.Weight > 0 && t.verify(name, signature) {
+			return variant, true
+		}
+	}
+
+	return t.pick(), false
+}
+
+// pick chooses a variant at random according to the weights
+func (t *ABTest) pick() *ABVariant {
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(t.totalWeight)))
+	if err != nil {
+		return t.variants[0]
+	}
+	remaining := int(n.Int64())
+	for _, variant := range t.variants {
+		if remaining < variant.Weight {
+			return variant
+		}
+		remaining -= variant.Weight
+	}
+	return t.variants[len(t.variants)-1]
+}
+
+// sign returns the cookie signature for a variant name
+func (t *ABTest) sign(name string) string {
+	mac := hmac.New(sha256.New, t.secret)
+	mac.Write([]byte(name))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verify checks a cookie signature in constant time
+func (t *ABTest) verify(name string, signature string) bool {
+	return hmac.Equal([]byte(signature), []byte(t.sign(name)))
+}
@@ -0,0 +1,269 @@
+package server
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ezhttp/ezhttp/internal/config"
+	"github.com/ezhttp/ezhttp/internal/logger"
+	"github.com/ezhttp/ezhttp/internal/proxy"
+	"github.com/ezhttp/ezhttp/internal/ratelimit"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// BasicAuth protects path prefixes with htpasswd users and bearer tokens
+type BasicAuth struct {
+	realm   string
+	users   map[string]string // user -> bcrypt or argon2 PHC hash
+	tokens  [][]byte
+	rules   []authRule
+	limiter *proxy.ProxyLimiter
+
+	// Compared against when the user is unknown so timing does not reveal valid names
+	dummyHash []byte
+}
+
+type authRule struct {
+	prefix string
+	users  map[string]bool // empty = any authenticated user or token
+	public bool
+}
+
+// NewBasicAuth creates the authenticator for a site. Returns nil when no rules are configured
+func NewBasicAuth(cfg *config.DataConfigAuth) (*BasicAuth, error) {
+	if len(cfg.Rules) == 0 {
+		return nil, nil
+	}
+
+	blockDuration := 15 * time.Minute
+	if cfg.BlockDuration != "" {
+		d, err := time.ParseDuration(cfg.BlockDuration)
+		if err != nil {
+			return nil, fmt.Errorf("invalid block duration: %w", err)
+		}
+		blockDuration = d
+	}
+
+	a := &BasicAuth{
+		realm: cfg.Realm,
+		users: make(map[string]string),
+		// Only the auth failure tracking of the limiter is used here
+		limiter: proxy.NewProxyLimiter(60, 10, cfg.MaxAuthAttempts, blockDuration),
+	}
+
+	dummyHash, err := bcrypt.GenerateFromPassword([]byte("ezhttp"), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate dummy hash: %w", err)
+	}
+	a.dummyHash = dummyHash
+
+	if cfg.UsersFile != "" {
+		users, err := loadHtpasswd(cfg.UsersFile)
+		if err != nil {
+			return nil, err
+		}
+		a.users = users
+	}
+
+	for _, token := range cfg.Tokens {
+		a.tokens = append(a.tokens, []byte(token))
+	}
+
+	for _, rule := range cfg.Rules {
+		r := authRule{
+			// "/staging/" and "/staging" protect the same paths, including "/staging" itself
+			prefix: strings.TrimSuffix(rule.Prefix, "/"),
+			users:  make(map[string]bool),
+			public: rule.Public,
+		}
+		for _, user := range rule.Users {
+			r.users[user] = true
+		}
+		a.rules = append(a.rules, r)
+	}
+
+	return a, nil
+}
+
+// loadHtpasswd reads "user:hash" lines. Only bcrypt and argon2 hashes are accepted
+func loadHtpasswd(filename string) (map[string]string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open users file: %w", err)
+	}
+	defer file.Close()
+
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		user, hash, found := strings.Cut(line, ":")
+		if !found || user == "" {
+			return nil, fmt.Errorf("users file line %d: expected user:hash", lineNumber)
+		}
+		if !isBcryptHash(hash) && !strings.HasPrefix(hash, "$argon2") {
+			logger.Warn("Skipping user with unsupported hash (use bcrypt or argon2)", "user", user)
+			continue
+		}
+		users[user] = hash
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read users file: %w", err)
+	}
+
+	logger.Info("Loaded users file", "file", filename, "users", len(users))
+	return users, nil
+}
+
+// matchRule returns the rule with the longest prefix matching path. Prefixes
+// match whole path segments, the root prefix matches every path
+func (a *BasicAuth) matchRule(path string) *authRule {
+	var best *authRule
+	for i := range a.rules {
+		rule := &a.rules[i]
+		matches := path == rule.prefix || strings.HasPrefix(path, rule.prefix+"/")
+		if matches && (best == nil || len(rule.prefix) > len(best.prefix)) {
+			best = rule
+		}
+	}
+	return best
+}
+
+// Check authenticates the request if its path is protected. It writes the
+// error response and returns false when the request must not continue.
+// protected reports whether the path required authentication
+func (a *BasicAuth) Check(w http.ResponseWriter, r *http.Request, path string) (allowed bool, protected bool) {
+	rule := a.matchRule(path)
+	if rule == nil || rule.public {
+		return true, false
+	}
+
+	ip := ratelimit.ExtractIP(r.RemoteAddr)
+
+	// Check if IP is blocked
+	if a.limiter.IsBlocked(ip) {
+		logger.Warn("Blocked IP attempted access", "ip", ip, "path", path)
+		writeAuthError(w, http.StatusForbidden, "Forbidden")
+		return false, true
+	}
+
+	user, ok := a.authenticate(r)
+	if ok && (len(rule.users) == 0 || (user != "" && rule.users[user])) {
+		a.limiter.ResetAuthFailures(ip)
+		return true, true
+	}
+
+	if ok {
+		// Valid credentials, but not for this path
+		logger.Warn("User not allowed for path", "user", user, "path", path, "ip", ip)
+		writeAuthError(w, http.StatusForbidden, "Forbidden")
+		return false, true
+	}
+
+	if r.Header.Get("Authorization") != "" {
+		a.limiter.RecordAuthFailure(ip)
+	}
+	w.Header().Set("WWW-Authenticate", `Basic realm="`+a.realm+`", charset="UTF-8"`)
+	writeAuthError(w, http.StatusUnauthorized, "Unauthorized")
+	return false, true
+}
+
+// authenticate validates Basic or Bearer credentials. Token logins have no user name
+func (a *BasicAuth) authenticate(r *http.Request) (string, bool) {
+	authHeader := r.Header.Get("Authorization")
+
+	const bearerPrefix = "Bearer "
+	if strings.HasPrefix(authHeader, bearerPrefix) {
+		token := []byte(authHeader[len(bearerPrefix):])
+		for _, candidate := range a.tokens {
+			if subtle.ConstantTimeCompare(token, candidate) == 1 {
+				return "", true
+			}
+		}
+		return "", false
+	}
+
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return "", false
+	}
+
+	hash, exists := a.users[user]
+	if !exists {
+		bcrypt.CompareHashAndPassword(a.dummyHash, []byte(password))
+		return "", false
+	}
+	if !verifyPasswordHash(hash, password) {
+		return "", false
+	}
+	return user, true
+}
+
+func isBcryptHash(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+// verifyPasswordHash checks a password against a bcrypt or argon2 PHC hash
+func verifyPasswordHash(hash string, password string) bool {
+	if isBcryptHash(hash) {
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	}
+	return verifyArgon2(hash, password)
+}
+
+// verifyArgon2 checks $argon2id$v=19$m=65536,t=3,p=4$salt$hash (or argon2i)
+func verifyArgon2(hash string, password string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[2] != "v="+strconv.Itoa(argon2.Version) {
+		return false
+	}
+
+	var memory, iterations uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &iterations, &threads); err != nil {
+		return false
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false
+	}
+	expected, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(expected) == 0 {
+		return false
+	}
+
+	var computed []byte
+	switch parts[1] {
+	case "argon2id":
+		computed = argon2.IDKey([]byte(password), salt, iterations, memory, threads, uint32(len(expected)))
+	case "argon2i":
+		computed = argon2.Key([]byte(password), salt, iterations, memory, threads, uint32(len(expected)))
+	default:
+		return false
+	}
+
+	return subtle.ConstantTimeCompare(computed, expected) == 1
+}
+
+func writeAuthError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	io.WriteString(w, message)
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/ezhttp/ezhttp/internal/config"
+)
+
+func TestBasicAuthPrefixMatching(t *testing.T) {
+	tests := []struct {
+		path      string
+		protected bool
+	}{
+		{"/dir", true},
+		{"/dir/", true},
+		{"/dir/index.html", true},
+		{"/dir/sub/file.txt", true},
+		{"/dirX", false},
+		{"/dirX/index.html", false},
+		{"/", false},
+	}
+
+	for _, prefix := range []string{"/dir", "/dir/"} {
+		auth, err := NewBasicAuth(&config.DataConfigAuth{
+			Realm:           "test",
+			Tokens:          []string{"0123456789abcdef"},
+			Rules:           []config.DataConfigAuthRule{{Prefix: prefix}},
+			MaxAuthAttempts: 5,
+		})
+		if err != nil {
+			t.Fatalf("NewBasicAuth(%q): %v", prefix, err)
+		}
+
+		for _, tt := range tests {
+			r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			w := httptest.NewRecorder()
+			// The handler checks the cleaned path, which has no trailing slash
+			allowed, protected := auth.Check(w, r, filepath.Clean(tt.path))
+			if protected != tt.protected || allowed == tt.protected {
+				t.Errorf("prefix %q, path %q: allowed=%v protected=%v, want protected=%v",
+					prefix, tt.path, allowed, protected, tt.protected)
+			}
+			if tt.protected && w.Code != http.StatusUnauthorized {
+				t.Errorf("prefix %q, path %q: status %d, want %d", prefix, tt.path, w.Code, http.StatusUnauthorized)
+			}
+		}
+	}
+}
+
+func TestBasicAuthPublicNestedPrefix(t *testing.T) {
+	auth, err := NewBasicAuth(&config.DataConfigAuth{
+		Realm:  "test",
+		Tokens: []string{"0123456789abcdef"},
+		Rules: []config.DataConfigAuthRule{
+			{Prefix: "/"},
+			{Prefix: "/public/", Public: true},
+		},
+		MaxAuthAttempts: 5,
+	})
+	if err != nil {
+		t.Fatalf("NewBasicAuth: %v", err)
+	}
+
+	tests := []struct {
+		path      string
+		protected bool
+	}{
+		{"/", true},
+		{"/index.html", true},
+		{"/public", false},
+		{"/public/", false},
+		{"/public/app.js", false},
+		{"/publicX", true},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		_, protected := auth.Check(httptest.NewRecorder(), r, filepath.Clean(tt.path))
+		if protected != tt.protected {
+			t.Errorf("path %q: protected=%v, want %v", tt.path, protected, tt.protected)
+		}
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/secret", nil)
+	r.Header.Set("Authorization", "Bearer 0123456789abcdef")
+	if allowed, _ := auth.Check(httptest.NewRecorder(), r, "/secret"); !allowed {
+		t.Error("valid token rejected")
+	}
+}
@@ -0,0 +1,238 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"container/list"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ezhttp/ezhttp/internal/logger"
+)
+
+// ContentCache keeps small static files in memory, together with their ETag
+// and a gzip variant, evicting the least recently used entries once the
+// byte budget is exceeded. Entries are revalidated against the file's
+// modification time at most once per revalidate interval, so hot files are
+// served without touching the file system in between
+type ContentCache struct {
+	mu          sync.Mutex
+	entries     map[string]*list.Element
+	lru         *list.List
+	fs          http.FileSystem
+	maxBytes    int64
+	maxFileSize int64
+	revalidate  time.Duration
+	curBytes    int64
+}
+
+type contentEntry struct {
+	path     string
+	body     []byte
+	gzipBody []byte
+	etag     string
+	modTime  time.Time
+	size     int64
+	checked  time.Time
+}
+
+// NewContentCache creates a content cache reading through fs (normally the
+// site's SecureFileSystem, so its extension and symlink checks still apply)
+func NewContentCache(fs http.FileSystem, maxBytes int64, maxFileSize int64, revalidate time.Duration) *ContentCache {
+	return &ContentCache{
+		entries:     make(map[string]*list.Element),
+		lru:         list.New(),
+		fs:          fs,
+		maxBytes:    maxBytes,
+		maxFileSize: maxFileSize,
+		revalidate:  revalidate,
+	}
+}
+
+// Serve writes the cached file for path. It returns false without writing
+// anything when the file is not cacheable, leaving it to the file server.
+// The caller sets Content-Type and Cache-Control beforehand
+func (c *ContentCache) Serve(w http.ResponseWriter, r *http.Request, path string) bool {
+	entry := c.get(path)
+	if entry == nil {
+		return false
+	}
+
+	body := entry.body
+	etag := entry.etag
+	if entry.gzipBody != nil {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if acceptsGzip(r) {
+			body = entry.gzipBody
+			etag = strings.TrimSuffix(entry.etag, `"`) + `-gzip"`
+			w.Header().Set("Content-Encoding", "gzip")
+		}
+	}
+	w.Header().Set("ETag", etag)
+
+	// Handles HEAD, Range, If-None-Match and If-Modified-Since
+	http.ServeContent(w, r, path, entry.modTime, bytes.NewReader(body))
+	return true
+}
+
+// get returns a fresh entry for path, loading or revalidating it if needed
+func (c *ContentCache) get(path string) *contentEntry {
+	now := time.Now()
+
+	c.mu.Lock()
+	if elem, found := c.entries[path]; found {
+		entry := elem.Value.(*contentEntry)
+		if now.Sub(entry.checked) < c.revalidate {
+			c.lru.MoveToFront(elem)
+			c.mu.Unlock()
+			return entry
+		}
+	}
+	c.mu.Unlock()
+
+	// Slow path: check the file system outside the lock
+	file, err := c.fs.Open(path)
+	if err != nil {
+		c.remove(path)
+		return nil
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil || stat.IsDir() || stat.Size() > c.maxFileSize {
+		c.remove(path)
+		return nil
+	}
+
+	c.mu.Lock()
+	if elem, found := c.entries[path]; found {
+		entry := elem.Value.(*contentEntry)
+		if entry.modTime.Equal(stat.ModTime()) && entry.size == stat.Size() {
+			// Unchanged, extend validity
+			entry.checked = now
+			c.lru.MoveToFront(elem)
+			c.mu.Unlock()
+			return entry
+		}
+	}
+	c.mu.Unlock()
+
+	body, err := io.ReadAll(io.LimitReader(file, c.maxFileSize+1))
+	if err != nil || int64(len(body)) != stat.Size() {
+		c.remove(path)
+		return nil
+	}
+
+	sum := sha256.Sum256(body)
+	entry := &contentEntry{
+		path:    path,
+		body:    body,
+		etag:    `"` + base64.RawURLEncoding.EncodeToString(sum[:18]) + `"`,
+		modTime: stat.ModTime(),
+		size:    stat.Size(),
+		checked: now,
+	}
+	if isCompressible(path) {
+		entry.gzipBody = gzipBytes(body)
+	}
+
+	c.put(entry)
+	return entry
+}
+
+// put stores an entry, evicting least recently used entries over budget
+func (c *ContentCache) put(entry *contentEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, found := c.entries[entry.path]; found {
+		c.curBytes -= elem.Value.(*contentEntry).cost()
+		c.lru.Remove(elem)
+	}
+
+	c.entries[entry.path] = c.lru.PushFront(entry)
+	c.curBytes += entry.cost()
+
+	evicted := 0
+	for c.curBytes > c.maxBytes && c.lru.Len() > 1 {
+		oldest := c.lru.Back()
+		old := oldest.Value.(*contentEntry)
+		c.lru.Remove(oldest)
+		delete(c.entries, old.path)
+		c.curBytes -= old.cost()
+		evicted++
+	}
+	if evicted > 0 {
+		logger.Debug("Evicted content cache entries", "count", evicted, "bytes", c.curBytes)
+	}
+}
+
+// remove drops an entry if present
+func (c *ContentCache) remove(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, found := c.entries[path]; found {
+		c.curBytes -= elem.Value.(*contentEntry).cost()
+		c.lru.Remove(elem)
+		delete(c.entries, path)
+	}
+}
+
+// cost is the memory accounted for an entry
+func (e *contentEntry) cost() int64 {
+	return int64(len(e.body) + len(e.gzipBody) + len(e.path))
+}
+
+// isCompressible reports whether a gzip variant is worth keeping for path
+func isCompressible(path string) bool {
+	for _, ext := range []string{".html", ".htm", ".css", ".js", ".json", ".map", ".webmanifest", ".txt", ".svg", ".ico"} {
+		if strings.HasSuffix(path, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// gzipBytes compresses body, returning nil when that does not save space
+func gzipBytes(body []byte) []byte {
+	var buf bytes.Buffer
+	gz, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	if err != nil {
+		return nil
+	}
+	if _, err := gz.Write(body); err != nil {
+		return nil
+	}
+	if err := gz.Close(); err != nil {
+		return nil
+	}
+	if buf.Len() >= len(body) {
+		return nil
+	}
+	return buf.Bytes()
+}
+
+// acceptsGzip reports whether the client accepts gzip content encoding
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if !strings.EqualFold(strings.TrimSpace(coding), "gzip") {
+			continue
+		}
+		// "gzip;q=0" explicitly refuses the encoding
+		if qValue, found := strings.CutPrefix(strings.TrimSpace(params), "q="); found {
+			if q, err := strconv.ParseFloat(qValue, 64); err == nil && q == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+)
+
+// EarlyHint is a preloadable resource referenced by the index template
+type EarlyHint struct {
+	URL         string
+	Rel         string // "preload" or "modulepreload"
+	As          string
+	Type        string
+	CrossOrigin string // "", "anonymous" or "use-credentials"
+	Nonce       bool   // The tag carried the nonce placeholder
+}
+
+// ExtractEarlyHints collects <link rel=preload|modulepreload|stylesheet> and
+// <script src> references from an index template, in document order
+func ExtractEarlyHints(html string, placeholder string) []EarlyHint {
+	hints := make([]EarlyHint, 0)
+	seen := make(map[string]bool)
+
+	for _, tag := range sriTagPattern.FindAllString(html, -1) {
+		attrs := parseTagAttrs(tag)
+		hint := EarlyHint{
+			Type:  attrs["type"],
+			Nonce: placeholder != "" && attrs["nonce"] == placeholder,
+		}
+
+		if strings.HasPrefix(strings.ToLower(tag), "<script") {
+			hint.URL = attrs["src"]
+			hint.Rel = "preload"
+			hint.As = "script"
+			hint.Type = ""
+			if strings.EqualFold(attrs["type"], "module") {
+				hint.Rel = "modulepreload"
+				hint.As = ""
+			}
+		} else {
+			hint.URL = attrs["href"]
+			switch strings.ToLower(attrs["rel"]) {
+			case "preload":
+				hint.Rel = "preload"
+				hint.As = attrs["as"]
+			case "modulepreload":
+				hint.Rel = "modulepreload"
+				hint.Type = ""
+			case "stylesheet":
+				hint.Rel = "preload"
+				hint.As = "style"
+				hint.Type = ""
+			default:
+				continue
+			}
+		}
+
+		// Skip empty references and anything that would break the header syntax
+		if hint.URL == "" || strings.ContainsAny(hint.URL, "<>\" \t\r\n") || seen[hint.URL] {
+			continue
+		}
+		if hint.Rel == "preload" && hint.As == "" {
+			continue
+		}
+		seen[hint.URL] = true
+
+		if crossOrigin, ok := attrs["crossorigin"]; ok {
+			if strings.EqualFold(crossOrigin, "use-credentials") {
+				hint.CrossOrigin = "use-credentials"
+			} else {
+				hint.CrossOrigin = "anonymous"
+			}
+		} else if hint.Rel == "modulepreload" {
+			// Module scripts are always fetched in CORS mode
+			hint.CrossOrigin = "anonymous"
+		}
+
+		hints = append(hints, hint)
+	}
+
+	return hints
+}
+
+// LinkHeader formats the hint as a Link header value
+func (h EarlyHint) LinkHeader(nonce string) string {
+	var b strings.Builder
+	b.WriteString("<" + h.URL + ">; rel=" + h.Rel)
+	if h.As != "" {
+		b.WriteString("; as=" + h.As)
+	}
+	if h.Type != "" {
+		b.WriteString(`; type="` + h.Type + `"`)
+	}
+	if h.CrossOrigin == "use-credentials" {
+		b.WriteString("; crossorigin=use-credentials")
+	} else if h.CrossOrigin != "" {
+		b.WriteString("; crossorigin")
+	}
+	if h.Nonce && nonce != "" {
+		b.WriteString("; nonce=" + nonce)
+	}
+	return b.String()
+}
+
+// WriteEarlyHints adds Link headers for the hints and, for HTTP/1.1+ clients,
+// flushes them as a 103 Early Hints response. Only the Link headers are sent
+// in the 103, headers meant for the final response such as Set-Cookie stay
+// back. The Link headers remain set for the final response
+func WriteEarlyHints(w http.ResponseWriter, r *http.Request, hints []EarlyHint, nonce string) {
+	if len(hints) == 0 {
+		return
+	}
+	header := w.Header()
+	for _, hint := range hints {
+		header.Add("Link", hint.LinkHeader(nonce))
+	}
+	if !r.ProtoAtLeast(1, 1) {
+		return
+	}
+
+	// The 103 is written from the current header map, so it holds only the
+	// Link values while it is sent
+	final := header.Clone()
+	for name := range header {
+		if name != "Link" {
+			delete(header, name)
+		}
+	}
+	w.WriteHeader(http.StatusEarlyHints)
+	for name, values := range final {
+		header[name] = values
+	}
+}
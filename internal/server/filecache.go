@@ -1,21 +1,32 @@
 package server
 
 import (
+	"io/fs"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ezhttp/ezhttp/internal/logger"
+	"github.com/fsnotify/fsnotify"
 )
 
 // FileExistenceCache caches file existence checks to avoid redundant stat calls
 type FileExistenceCache struct {
-	mu       sync.RWMutex
-	cache    map[string]*cacheEntry
-	basePath string
-	ttl      time.Duration
+	mu          sync.RWMutex
+	cache       map[string]*cacheEntry
+	basePath    string
+	positiveTTL time.Duration
+	negativeTTL time.Duration
+	maxEntries  int
+	watcher     *fsnotify.Watcher
+	manifest    *Manifest
+
+	hits      atomic.Uint64
+	misses    atomic.Uint64
+	evictions atomic.Uint64
 }
 
 type cacheEntry struct {
@@ -24,17 +35,29 @@ type cacheEntry struct {
 	timestamp    time.Time
 }
 
-// NewFileExistenceCache creates a new file existence cache
-func NewFileExistenceCache(basePath string, ttl time.Duration) (*FileExistenceCache, error) {
+// FileCacheStats is a snapshot of the cache counters
+type FileCacheStats struct {
+	Entries   int
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+}
+
+// NewFileExistenceCache creates a new file existence cache. Paths that exist
+// are cached for positiveTTL, missing ones for negativeTTL, and at most
+// maxEntries paths are kept
+func NewFileExistenceCache(basePath string, positiveTTL time.Duration, negativeTTL time.Duration, maxEntries int) (*FileExistenceCache, error) {
 	absPath, err := filepath.Abs(basePath)
 	if err != nil {
 		return nil, err
 	}
 
 	cache := &FileExistenceCache{
-		cache:    make(map[string]*cacheEntry),
-		basePath: absPath,
-		ttl:      ttl,
+		cache:       make(map[string]*cacheEntry),
+		basePath:    absPath,
+		positiveTTL: positiveTTL,
+		negativeTTL: negativeTTL,
+		maxEntries:  maxEntries,
 	}
 
 	// Start cleanup goroutine
@@ -55,17 +78,22 @@ func (c *FileExistenceCache) CheckPath(path string) (exists bool, resolvedPath s
 	// Check cache first
 	c.mu.RLock()
 	entry, found := c.cache[cleanPath]
-	if found && time.Since(entry.timestamp) < c.ttl {
+	if found && time.Since(entry.timestamp) < c.ttlFor(entry.exists) {
 		c.mu.RUnlock()
+		c.hits.Add(1)
 		return entry.exists, entry.resolvedPath
 	}
 	c.mu.RUnlock()
+	c.misses.Add(1)
 
 	// Cache miss or expired, check file system
 	exists, resolvedPath = c.checkFileSystem(cleanPath)
 
 	// Update cache
 	c.mu.Lock()
+	if _, found := c.cache[cleanPath]; !found && len(c.cache) >= c.maxEntries {
+		c.evictLocked()
+	}
 	c.cache[cleanPath] = &cacheEntry{
 		exists:       exists,
 		resolvedPath: resolvedPath,
@@ -76,8 +104,85 @@ func (c *FileExistenceCache) CheckPath(path string) (exists bool, resolvedPath s
 	return exists, resolvedPath
 }
 
+// Stats returns the current cache counters
+func (c *FileExistenceCache) Stats() FileCacheStats {
+	c.mu.RLock()
+	entries := len(c.cache)
+	c.mu.RUnlock()
+
+	return FileCacheStats{
+		Entries:   entries,
+		Hits:      c.hits.Load(),
+		Misses:    c.misses.Load(),
+		Evictions: c.evictions.Load(),
+	}
+}
+
+// LogStats logs the cache counters every interval
+func (c *FileExistenceCache) LogStats(site string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		stats := c.Stats()
+		logger.Info("File cache stats",
+			"site", site,
+			"entries", stats.Entries,
+			"hits", stats.Hits,
+			"misses", stats.Misses,
+			"evictions", stats.Evictions)
+	}
+}
+
+// ttlFor returns the TTL for positive or negative entries
+func (c *FileExistenceCache) ttlFor(exists bool) time.Duration {
+	if exists {
+		return c.positiveTTL
+	}
+	return c.negativeTTL
+}
+
+// evictLocked makes room for new entries, dropping expired and negative
+// entries first since random missing paths are what an attacker can flood.
+// Must be called with the write lock held
+func (c *FileExistenceCache) evictLocked() {
+	toRemove := c.maxEntries / 10
+	if toRemove < 1 {
+		toRemove = 1
+	}
+
+	now := time.Now()
+	removed := 0
+	for _, onlyNegative := range []bool{true, false} {
+		for path, entry := range c.cache {
+			if removed >= toRemove {
+				break
+			}
+			expired := now.Sub(entry.timestamp) >= c.ttlFor(entry.exists)
+			if expired || !entry.exists || !onlyNegative {
+				delete(c.cache, path)
+				removed++
+			}
+		}
+	}
+
+	c.evictions.Add(uint64(removed))
+}
+
+// SetManifest makes lookups use the startup manifest instead of stat calls
+func (c *FileExistenceCache) SetManifest(m *Manifest) {
+	c.mu.Lock()
+	c.manifest = m
+	c.cache = make(map[string]*cacheEntry)
+	c.mu.Unlock()
+}
+
 // checkFileSystem performs the actual file system check
 func (c *FileExistenceCache) checkFileSystem(cleanPath string) (bool, string) {
+	if c.manifest != nil {
+		return c.checkManifest(filepath.ToSlash(cleanPath))
+	}
+
 	fullPath := filepath.Join(c.basePath, cleanPath)
 
 	// Security check
@@ -104,9 +209,115 @@ func (c *FileExistenceCache) checkFileSystem(cleanPath string) (bool, string) {
 	return false, ""
 }
 
+// checkManifest resolves the path against the manifest
+func (c *FileExistenceCache) checkManifest(cleanPath string) (bool, string) {
+	if _, found := c.manifest.Lookup(cleanPath); found {
+		return true, cleanPath
+	}
+	if _, found := c.manifest.Lookup(cleanPath + ".html"); found {
+		return true, cleanPath + ".html"
+	}
+	return false, ""
+}
+
+// Watch invalidates entries as soon as files below the base path are created,
+// removed or renamed, instead of waiting for the TTL to expire
+func (c *FileExistenceCache) Watch() error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	// fsnotify is not recursive, so every directory gets its own watch
+	err = filepath.WalkDir(c.basePath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() {
+			if strings.HasPrefix(d.Name(), ".") && path != c.basePath {
+				return filepath.SkipDir
+			}
+			return watcher.Add(path)
+		}
+		return nil
+	})
+	if err != nil {
+		watcher.Close()
+		return err
+	}
+
+	c.watcher = watcher
+	go c.watchLoop()
+	return nil
+}
+
+// watchLoop processes file system events
+func (c *FileExistenceCache) watchLoop() {
+	for {
+		select {
+		case event, ok := <-c.watcher.Events:
+			if !ok {
+				return
+			}
+			if !event.Has(fsnotify.Create) && !event.Has(fsnotify.Remove) && !event.Has(fsnotify.Rename) {
+				continue
+			}
+
+			// New directories need their own watch
+			if event.Has(fsnotify.Create) {
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+					if err := c.watcher.Add(event.Name); err != nil {
+						logger.Warn("Failed to watch new directory", "path", event.Name, "error", err)
+					}
+				}
+			}
+
+			relPath, err := filepath.Rel(c.basePath, event.Name)
+			if err != nil || strings.HasPrefix(relPath, "..") {
+				continue
+			}
+			c.invalidate("/" + filepath.ToSlash(relPath))
+
+		case err, ok := <-c.watcher.Errors:
+			if !ok {
+				return
+			}
+			logger.Warn("File watcher error", "error", err)
+		}
+	}
+}
+
+// invalidate drops entries for path, its extensionless ".html" alias and
+// anything below it (for directories)
+func (c *FileExistenceCache) invalidate(path string) {
+	prefix := path + "/"
+	alias := strings.TrimSuffix(path, ".html")
+
+	c.mu.Lock()
+	removed := 0
+	for cachedPath := range c.cache {
+		if cachedPath == path || cachedPath == alias || strings.HasPrefix(cachedPath, prefix) {
+			delete(c.cache, cachedPath)
+			removed++
+		}
+	}
+	c.mu.Unlock()
+
+	if removed > 0 {
+		logger.Debug("Invalidated file cache entries", "path", path, "count", removed)
+	}
+}
+
 // cleanupLoop periodically removes expired entries
 func (c *FileExistenceCache) cleanupLoop() {
-	ticker := time.NewTicker(5 * time.Minute)
+	interval := c.positiveTTL
+	if c.negativeTTL < interval {
+		interval = c.negativeTTL
+	}
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
 	for range ticker.C {
@@ -121,7 +332,7 @@ func (c *FileExistenceCache) cleanupExpired() {
 
 	c.mu.RLock()
 	for path, entry := range c.cache {
-		if now.Sub(entry.timestamp) > c.ttl {
+		if now.Sub(entry.timestamp) > c.ttlFor(entry.exists) {
 			expired = append(expired, path)
 		}
 	}
@@ -7,12 +7,13 @@ import (
 	"strings"
 
 	"github.com/ezhttp/ezhttp/internal/logger"
+	"github.com/ezhttp/ezhttp/internal/ratelimit"
+	"github.com/ezhttp/ezhttp/internal/security"
 	"github.com/ezhttp/ezhttp/internal/utils"
-	"github.com/tdewolff/minify/v2"
 )
 
 // MwNonce is the main HTTP handler middleware that adds nonces and serves files
-func MwNonce(minhttpfs http.Handler, compiledCsp string, cachedIndexString []string, minifier *minify.M, banner []string, fileCache *FileExistenceCache) http.HandlerFunc {
+func MwNonce(site *Site) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 
 		// Extract Path
@@ -42,6 +43,10 @@ func MwNonce(minhttpfs http.Handler, compiledCsp string, cachedIndexString []str
 		if path == "/health" {
 			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 			w.WriteHeader(http.StatusOK)
+			if site.Maintenance.Active() {
+				io.WriteString(w, "MAINTENANCE")
+				return
+			}
 			io.WriteString(w, "OK")
 			return
 		}
@@ -50,6 +55,44 @@ func MwNonce(minhttpfs http.Handler, compiledCsp string, cachedIndexString []str
 		w.Header().Set("Referrer-Policy", "same-origin")
 		w.Header().Set("X-Content-Type-Options", "nosniff")
 
+		// Site Headers (an empty value removes the header)
+		for name, value := range site.Headers {
+			if value == "" {
+				w.Header().Del(name)
+			} else {
+				w.Header().Set(name, value)
+			}
+		}
+
+		// Maintenance Mode
+		if site.Maintenance.Active() && !site.Maintenance.Bypass(r) {
+			site.Maintenance.Serve(w, r, site)
+			return
+		}
+
+		// Signed URLs
+		signed := false
+		if signer := security.MatchURLSigner(site.URLSigners, cleanPath); signer != nil {
+			if err := signer.Verify(cleanPath, r.URL.Query(), ratelimit.ExtractIP(r.RemoteAddr)); err != nil {
+				logger.Warn("Signed URL rejected", "path", cleanPath, "reason", err.Error(), "ip", ratelimit.ExtractIP(r.RemoteAddr))
+				w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+				w.WriteHeader(http.StatusForbidden)
+				io.WriteString(w, "Forbidden")
+				return
+			}
+			signed = true
+		}
+
+		// Authentication (a valid signed link is sufficient on its own)
+		protected := false
+		if site.Auth != nil && !signed {
+			var allowed bool
+			allowed, protected = site.Auth.Check(w, r, cleanPath)
+			if !allowed {
+				return
+			}
+		}
+
 		// Redirect Root Index (before any path modifications)
 		if path == "/index.html" || path == "/index.htm" || path == "/index" {
 			// Redirect, Permanent
@@ -57,6 +100,11 @@ func MwNonce(minhttpfs http.Handler, compiledCsp string, cachedIndexString []str
 			return
 		}
 
+		// Directory listings (only for directories without an index.html)
+		if site.Lister != nil && site.Lister.Listable(cleanPath) && site.Lister.Serve(w, r, cleanPath, site, protected) {
+			return
+		}
+
 		// Handle trailing slash
 		if path != "/" && strings.HasSuffix(path, "/") {
 			//log.Println("LAST CHAR IS / => /index.html")
@@ -64,7 +112,12 @@ func MwNonce(minhttpfs http.Handler, compiledCsp string, cachedIndexString []str
 		}
 
 		// Check for File using cache
-		pathexists, pathchecked := fileCache.CheckPath(path)
+		pathexists, pathchecked := site.FileCache.CheckPath(path)
+
+		// The maintenance page template is never served raw
+		if pathexists && site.Maintenance.IsPage(pathchecked) {
+			pathexists = false
+		}
 		//log.Println("CHECK PATH:", pathexists, pathchecked)
 
 		// Doesn't Happen. Weird. We re-assign "/" to "/index.html" above to address.
@@ -88,31 +141,81 @@ func MwNonce(minhttpfs http.Handler, compiledCsp string, cachedIndexString []str
 
 			// Write Response
 			//_, _ = w.Write([]byte("BYTE"))
+			// Pick the A/B variant and the localized template, if any
+			index, earlyHints := site.Index, site.EarlyHints
+			localize := site.Languages != nil
+			if site.ABTest != nil {
+				variant := site.ABTest.Select(w, r)
+				if variant.Index != nil {
+					index, earlyHints = variant.Index, variant.EarlyHints
+					localize = false
+				}
+				logger.Debug("Serving index variant",
+					"site", site.Name,
+					"variant", variant.Name,
+					"uri", r.URL.RequestURI(),
+					"ip", ratelimit.ExtractIP(r.RemoteAddr))
+			}
+			if localize {
+				variant := site.Languages.Select(w, r, cleanPath)
+				index, earlyHints = variant.Index, variant.EarlyHints
+				w.Header().Set("Content-Language", variant.Lang)
+			}
+
+			w.Header().Set("Content-Security-Policy", strings.ReplaceAll(site.Csp, "RANDOM", nonce))
+			WriteEarlyHints(w, r, earlyHints, nonce)
 			w.Header().Set("Content-Type", "text/html; charset=utf-8")
-			w.Header().Set("Cache-Control", "no-cache")
-			w.Header().Set("Content-Security-Policy", strings.ReplaceAll(compiledCsp, "RANDOM", nonce))
+			setCacheControl(w.Header(), "no-cache", protected)
 			w.WriteHeader(http.StatusOK)
-			io.WriteString(w, GenerateIndexWithNonce(nonce, cachedIndexString, minifier, banner))
+			io.WriteString(w, GenerateIndexWithNonce(nonce, index, site.Minifier, site.Banner, site.ClientConfig))
 			return
 		} else {
 			//log.Println("ACTUALLY EXISTS:", pathchecked)
+
+			// Resizing works on the original, so it takes precedence over negotiation
+			resize := site.ImageResizer != nil && r.URL.Query().Has("w") && site.ImageResizer.Resizable(pathchecked)
+
+			// Serve a modern image format when the client accepts one
+			if !resize && site.ImageNegotiator != nil && site.ImageNegotiator.Negotiable(pathchecked) {
+				w.Header().Add("Vary", "Accept")
+				pathchecked = site.ImageNegotiator.Negotiate(r, pathchecked, site.FileCache)
+			}
+
 			r.URL.Path = pathchecked
 
 			cType, _, cacheable := utils.GetContentTypeByPath(pathchecked)
 			w.Header().Set("Content-Type", cType)
-			if cacheable {
+			if signed {
+				// Time-limited links must not outlive their signature in shared caches
+				w.Header().Set("Cache-Control", "private, no-store")
+			} else if cacheable {
 				//log.Println("CACHE: YES")
-				w.Header().Set("Cache-Control", "max-age=31536000, immutable")
+				setCacheControl(w.Header(), "max-age=31536000, immutable", protected)
 			} else {
 				//log.Println("CACHE: NO")
-				w.Header().Set("Cache-Control", "no-cache")
+				setCacheControl(w.Header(), "no-cache", protected)
+			}
+			if resize && site.ImageResizer.Serve(w, r, pathchecked) {
+				return
+			}
+			if site.ContentCache != nil && site.ContentCache.Serve(w, r, pathchecked) {
+				return
 			}
 			// if minify {
 			// 	minifier.Middleware(minhttpfs)
 			// } else {
 			//log.Println("ServeHTTP")
-			minhttpfs.ServeHTTP(w, r)
+			site.httpfs.ServeHTTP(w, r)
 			//}
 		}
 	}
 }
+
+// setCacheControl sets Cache-Control, keeping authenticated responses out of
+// shared caches
+func setCacheControl(h http.Header, value string, protected bool) {
+	if protected {
+		value = "private, " + value
+	}
+	h.Set("Cache-Control", value)
+}
@@ -1,9 +1,13 @@
 package server
 
 import (
+	"encoding/json"
 	"os"
+	"path"
+	"path/filepath"
 	"strings"
 
+	"github.com/ezhttp/ezhttp/internal/config"
 	"github.com/ezhttp/ezhttp/internal/logger"
 	"github.com/tdewolff/minify/v2"
 )
@@ -11,28 +15,66 @@ import (
 // CachedIndexString holds the split index.html file
 var CachedIndexString []string
 
-// LoadIndexCache loads and splits the index.html file
-func LoadIndexCache() ([]string, error) {
-	fileBytes, _ := os.ReadFile("./public/index.html")
+// LoadIndexCache loads the index template and splits it on the nonce placeholder.
+// When sri is enabled, local assets referenced from the template are hashed
+// relative to the template's directory. With a manifest, the template must
+// match the hash recorded in it
+func LoadIndexCache(rootDir string, indexFile string, placeholder string, sri *config.DataConfigSri, manifest *Manifest) ([]string, error) {
+	indexPath := filepath.Join(rootDir, indexFile)
+	fileBytes, err := os.ReadFile(indexPath)
+	if err != nil {
+		return []string{""}, err
+	}
+	if manifest != nil {
+		if err := manifest.Verify(path.Clean("/"+filepath.ToSlash(indexFile)), fileBytes); err != nil {
+			return []string{""}, err
+		}
+	}
 	fileString := string(fileBytes)
-	fileSplit := strings.Split(fileString, "NONCEHERE")
+	if sri != nil && sri.Enabled {
+		fileString, err = ApplySubresourceIntegrity(fileString, filepath.Dir(indexPath), sri)
+		if err != nil {
+			return []string{""}, err
+		}
+	}
+	fileSplit := strings.Split(fileString, placeholder)
 	nonceFieldCount := len(fileSplit) - 1
 	if nonceFieldCount == 0 {
-		logger.Info("No nonce field found. Use NONCEHERE in your file to use it", "nonceCount", nonceFieldCount)
+		logger.Info("No nonce field found. Use "+placeholder+" in your file to use it", "nonceCount", nonceFieldCount, "file", indexPath)
 	} else if nonceFieldCount <= 2 {
 		// Expected: 1-2 nonces (style, script)
-		logger.Info("Found nonce fields", "nonceCount", nonceFieldCount)
+		logger.Info("Found nonce fields", "nonceCount", nonceFieldCount, "file", indexPath)
 	} else {
 		// More than 2 nonces is unusual and might indicate an issue
-		logger.Warn("Unusually high number of nonce fields found", "nonceCount", nonceFieldCount, "expected", "1-2 (style, script)")
+		logger.Warn("Unusually high number of nonce fields found", "nonceCount", nonceFieldCount, "expected", "1-2 (style, script)", "file", indexPath)
 	}
 
 	//bufio.NewScanner()
 	return fileSplit, nil
 }
 
+// ClientConfigScriptID is the element id of the injected client config block
+const ClientConfigScriptID = "ezhttp-config"
+
+// MarshalClientConfig encodes client config for embedding in a script element.
+// encoding/json escapes <, > and & (and U+2028/U+2029), so the result cannot
+// terminate the script element early. Returns "" when there is nothing to inject
+func MarshalClientConfig(clientConfig map[string]any) (string, error) {
+	if len(clientConfig) == 0 {
+		return "", nil
+	}
+	encoded, err := json.Marshal(clientConfig)
+	if err != nil {
+		return "", err
+	}
+	return string(encoded), nil
+}
+
 // GenerateIndexWithNonce generates the index HTML with the nonce inserted
-func GenerateIndexWithNonce(nonce string, cachedIndexString []string, minifier *minify.M, banner []string) string {
+// and, when clientConfig is set, a JSON config block readable by the frontend:
+//
+//	JSON.parse(document.getElementById("ezhttp-config").textContent)
+func GenerateIndexWithNonce(nonce string, cachedIndexString []string, minifier *minify.M, banner []string, clientConfig string) string {
 	totalSlots := len(cachedIndexString)
 	finalReturn := make([]string, (totalSlots*2)-1)
 	for i := 0; i < totalSlots; i++ {
@@ -43,7 +85,11 @@ func GenerateIndexWithNonce(nonce string, cachedIndexString []string, minifier *
 	}
 	finalString := strings.Join(finalReturn, "")
 	minified, _ := minifier.String("text/html", finalString)
-	minifiedWithBanner := strings.Replace(minified, "</head>", strings.Join(banner, "\n")+"</head>", 1)
+	headInsert := strings.Join(banner, "\n")
+	if clientConfig != "" {
+		headInsert += `<script nonce="` + nonce + `" type="application/json" id="` + ClientConfigScriptID + `">` + clientConfig + `</script>`
+	}
+	minifiedWithBanner := strings.Replace(minified, "</head>", headInsert+"</head>", 1)
 	minifiedAngularNonce := strings.Replace(minifiedWithBanner, "ngcspnonce", "ngCspNonce", 1)
 	return minifiedAngularNonce
 	//buf := &bytes.Buffer{}
@@ -0,0 +1,168 @@
+package server
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ezhttp/ezhttp/internal/config"
+	"github.com/ezhttp/ezhttp/internal/logger"
+)
+
+// IndexVariant is the precomputed index template of one language
+type IndexVariant struct {
+	Lang       string
+	Index      []string
+	EarlyHints []EarlyHint
+}
+
+// LanguageNegotiator picks the index variant for a request
+type LanguageNegotiator struct {
+	variants    map[string]*IndexVariant // keyed by lowercase tag
+	defaultLang string
+	cookie      string
+	urlPrefix   bool
+}
+
+// LoadIndexTemplates loads index.<lang>.html (for index file index.html) for
+// every language through LoadIndexCache. Missing templates are skipped with a
+// warning. Any other error is returned
+func LoadIndexTemplates(rootDir string, indexFile string, languages []string, placeholder string, sri *config.DataConfigSri, manifest *Manifest) (map[string][]string, error) {
+	ext := filepath.Ext(indexFile)
+	base := strings.TrimSuffix(indexFile, ext)
+
+	templates := make(map[string][]string)
+	for _, lang := range languages {
+		templateFile := base + "." + lang + ext
+		index, err := LoadIndexCache(rootDir, templateFile, placeholder, sri, manifest)
+		if os.IsNotExist(err) {
+			logger.Warn("Localized index template not found", "language", lang, "file", templateFile)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		templates[lang] = index
+	}
+	return templates, nil
+}
+
+// NewLanguageNegotiator creates a negotiator for the loaded templates. The
+// default language falls back to fallbackIndex (the plain index file) when it
+// has no template of its own. Returns nil when no variant could be loaded
+func NewLanguageNegotiator(cfg *config.DataConfigLanguages, templates map[string][]string, fallbackIndex []string, earlyHints bool, placeholder string) *LanguageNegotiator {
+	defaultLang := cfg.Default
+	if defaultLang == "" && len(cfg.Available) > 0 {
+		defaultLang = cfg.Available[0]
+	}
+	if _, found := templates[defaultLang]; !found && defaultLang != "" {
+		templates[defaultLang] = fallbackIndex
+	}
+	if len(templates) < 2 {
+		return nil
+	}
+
+	n := &LanguageNegotiator{
+		variants:    make(map[string]*IndexVariant),
+		defaultLang: strings.ToLower(defaultLang),
+		cookie:      cfg.Cookie,
+		urlPrefix:   cfg.URLPrefixOrDefault(),
+	}
+	for lang, index := range templates {
+		variant := &IndexVariant{Lang: lang, Index: index}
+		if earlyHints {
+			variant.EarlyHints = ExtractEarlyHints(strings.Join(index, placeholder), placeholder)
+		}
+		n.variants[strings.ToLower(lang)] = variant
+	}
+	return n
+}
+
+// Languages returns the number of loaded variants
+func (n *LanguageNegotiator) Languages() int {
+	return len(n.variants)
+}
+
+// Select returns the variant for the request: URL prefix first, then the
+// cookie, then Accept-Language, then the default language. Vary is set
+// unless the URL prefix decided
+func (n *LanguageNegotiator) Select(w http.ResponseWriter, r *http.Request, cleanPath string) *IndexVariant {
+	if n.urlPrefix {
+		first, _, _ := strings.Cut(strings.TrimPrefix(cleanPath, "/"), "/")
+		if variant, found := n.variants[strings.ToLower(first)]; found {
+			return variant
+		}
+	}
+
+	// Without a URL prefix the choice depends on request headers
+	if n.cookie != "" {
+		w.Header().Add("Vary", "Cookie")
+	}
+	w.Header().Add("Vary", "Accept-Language")
+
+	if n.cookie != "" {
+		if cookie, err := r.Cookie(n.cookie); err == nil {
+			if variant, found := n.variants[strings.ToLower(cookie.Value)]; found {
+				return variant
+			}
+		}
+	}
+
+	for _, tag := range parseAcceptLanguage(r.Header.Get("Accept-Language")) {
+		if variant, found := n.variants[tag]; found {
+			return variant
+		}
+		// "de-AT" is served by "de"
+		if primary, _, found := strings.Cut(tag, "-"); found {
+			if variant, found := n.variants[primary]; found {
+				return variant
+			}
+		}
+	}
+
+	return n.variants[n.defaultLang]
+}
+
+// parseAcceptLanguage returns the lowercase language tags of an
+// Accept-Language header ordered by quality. Wildcards and q=0 are dropped
+func parseAcceptLanguage(header string) []string {
+	type weightedTag struct {
+		tag string
+		q   float64
+	}
+
+	tags := make([]weightedTag, 0)
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || tag == "*" {
+			continue
+		}
+		q := 1.0
+		if qValue, found := strings.CutPrefix(strings.TrimSpace(params), "q="); found {
+			parsed, err := strconv.ParseFloat(qValue, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		if q <= 0 {
+			continue
+		}
+		tags = append(tags, weightedTag{tag: tag, q: q})
+	}
+
+	// Stable, so equal weights keep the client's order
+	sort.SliceStable(tags, func(i, j int) bool {
+		return tags[i].q > tags[j].q
+	})
+
+	result := make([]string, len(tags))
+	for i, t := range tags {
+		result[i] = t.tag
+	}
+	return result
+}
@@ -0,0 +1,269 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ezhttp/ezhttp/internal/logger"
+	"github.com/ezhttp/ezhttp/internal/security"
+	"github.com/ezhttp/ezhttp/internal/utils"
+)
+
+// Placeholder the listing template uses where the nonce goes
+const listingNoncePlaceholder = "EZHTTP_LISTING_NONCE"
+
+var listingTemplate = template.Must(template.New("listing").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Index of {{.Path}}</title>
+<style nonce="` + listingNoncePlaceholder + `">
+body{font-family:system-ui,sans-serif;margin:2rem}
+table{border-collapse:collapse}
+th,td{padding:.2rem 1rem;text-align:left}
+td.size{text-align:right}
+</style>
+</head>
+<body>
+<h1>Index of {{.Path}}</h1>
+<table>
+<thead><tr><th><a href="?sort=name">Name</a></th><th><a href="?sort=size">Size</a></th><th><a href="?sort=modified">Modified</a></th></tr></thead>
+<tbody>
+{{if ne .Path "/"}}<tr><td><a href="../">../</a></td><td></td><td></td></tr>
+{{end}}{{range .Entries}}<tr><td><a href="{{.Href}}">{{.Name}}{{if .Dir}}/{{end}}</a></td><td class="size">{{if not .Dir}}{{.Size}}{{end}}</td><td>{{.Modified.Format "2006-01-02 15:04:05"}}</td></tr>
+{{end}}</tbody>
+</table>
+<p>{{if .PrevPage}}<a href="?sort={{.Sort}}&amp;page={{.PrevPage}}">Previous</a> {{end}}Page {{.Page}} of {{.Pages}} ({{.Total}} entries){{if .NextPage}} <a href="?sort={{.Sort}}&amp;page={{.NextPage}}">Next</a>{{end}}</p>
+</body>
+</html>
+`))
+
+// DirectoryLister renders listings of directories below opted-in prefixes
+type DirectoryLister struct {
+	prefixes []string
+	fs       http.FileSystem
+	manifest *Manifest
+	pageSize int
+}
+
+// ListingEntry is one file or directory of a listing
+type ListingEntry struct {
+	Name     string    `json:"name"`
+	Dir      bool      `json:"dir"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+	Href     string    `json:"-"`
+}
+
+// Listing is one page of a directory listing
+type Listing struct {
+	Path     string         `json:"path"`
+	Sort     string         `json:"sort"`
+	Page     int            `json:"page"`
+	Pages    int            `json:"pages"`
+	PageSize int            `json:"page_size"`
+	Total    int            `json:"total"`
+	Entries  []ListingEntry `json:"entries"`
+	PrevPage int            `json:"-"`
+	NextPage int            `json:"-"`
+}
+
+// NewDirectoryLister creates a lister reading through fs, which must allow
+// opening directories below prefixes. When manifest is set, only files it
+// contains are listed
+func NewDirectoryLister(prefixes []string, fs http.FileSystem, manifest *Manifest, pageSize int) *DirectoryLister {
+	return &DirectoryLister{
+		prefixes: prefixes,
+		fs:       fs,
+		manifest: manifest,
+		pageSize: pageSize,
+	}
+}
+
+// Listable reports whether cleanPath may be listed
+func (l *DirectoryLister) Listable(cleanPath string) bool {
+	for _, prefix := range l.prefixes {
+		if strings.HasPrefix(cleanPath+"/", prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Serve writes the listing of the directory at cleanPath. It returns false
+// without writing anything when cleanPath is not a listable directory.
+// Listings behind authentication are marked private
+func (l *DirectoryLister) Serve(w http.ResponseWriter, r *http.Request, cleanPath string, site *Site, protected bool) bool {
+	dir, err := l.fs.Open(cleanPath)
+	if err != nil {
+		return false
+	}
+	defer dir.Close()
+
+	stat, err := dir.Stat()
+	if err != nil || !stat.IsDir() {
+		return false
+	}
+
+	// Relative links only work from the canonical URL
+	if !strings.HasSuffix(r.URL.Path, "/") {
+		target := cleanPath + "/"
+		if r.URL.RawQuery != "" {
+			target += "?" + r.URL.RawQuery
+		}
+		http.Redirect(w, r, target, http.StatusMovedPermanently)
+		return true
+	}
+
+	infos, err := dir.Readdir(-1)
+	if err != nil {
+		logger.Warn("Failed to read directory", "path", cleanPath, "error", err)
+		return false
+	}
+
+	listing := l.buildListing(cleanPath, infos, r.URL.Query())
+
+	w.Header().Add("Vary", "Accept")
+	setCacheControl(w.Header(), "no-cache", protected)
+
+	if r.URL.Query().Get("format") == "json" || acceptsMediaType(r.Header.Get("Accept"), "application/json") {
+		body, err := json.Marshal(listing)
+		if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return true
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		w.Write(body)
+		return true
+	}
+
+	var page bytes.Buffer
+	if err := listingTemplate.Execute(&page, listing); err != nil {
+		logger.Error("Failed to render directory listing", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return true
+	}
+
+	nonce := utils.RandStringCharacters(32)
+	if nonce == "" {
+		logger.Error("Failed to generate secure nonce", "type", "security")
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return true
+	}
+
+	w.Header().Set("Content-Security-Policy", strings.ReplaceAll(site.Csp, "RANDOM", nonce))
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	segments := strings.Split(page.String(), listingNoncePlaceholder)
+	io.WriteString(w, GenerateIndexWithNonce(nonce, segments, site.Minifier, site.Banner, ""))
+	return true
+}
+
+// buildListing filters, sorts and paginates the directory entries
+func (l *DirectoryLister) buildListing(cleanPath string, infos []os.FileInfo, query url.Values) *Listing {
+	entries := make([]ListingEntry, 0, len(infos))
+	for _, info := range infos {
+		name := info.Name()
+		if strings.HasPrefix(name, ".") || info.Mode()&os.ModeSymlink != 0 {
+			continue
+		}
+		if !info.IsDir() {
+			if !info.Mode().IsRegular() {
+				continue
+			}
+			if ext := path.Ext(name); ext != "" && !security.AllowedExtensions[strings.ToLower(ext)] {
+				continue
+			}
+			if l.manifest != nil {
+				if _, found := l.manifest.Lookup(path.Join(cleanPath, name)); !found {
+					continue
+				}
+			}
+		}
+
+		entry := ListingEntry{
+			Name:     name,
+			Dir:      info.IsDir(),
+			Modified: info.ModTime().UTC(),
+			Href:     (&url.URL{Path: name}).String(),
+		}
+		if entry.Dir {
+			entry.Href += "/"
+		} else {
+			entry.Size = info.Size()
+		}
+		entries = append(entries, entry)
+	}
+
+	sortBy := query.Get("sort")
+	switch sortBy {
+	case "size", "modified":
+	default:
+		sortBy = "name"
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		// Directories first
+		if a.Dir != b.Dir {
+			return a.Dir
+		}
+		switch sortBy {
+		case "size":
+			if a.Size != b.Size {
+				return a.Size > b.Size
+			}
+		case "modified":
+			if !a.Modified.Equal(b.Modified) {
+				return a.Modified.After(b.Modified)
+			}
+		}
+		return a.Name < b.Name
+	})
+
+	pages := (len(entries) + l.pageSize - 1) / l.pageSize
+	if pages == 0 {
+		pages = 1
+	}
+	page, err := strconv.Atoi(query.Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	if page > pages {
+		page = pages
+	}
+
+	start := (page - 1) * l.pageSize
+	end := min(start+l.pageSize, len(entries))
+
+	listing := &Listing{
+		Path:     cleanPath + "/",
+		Sort:     sortBy,
+		Page:     page,
+		Pages:    pages,
+		PageSize: l.pageSize,
+		Total:    len(entries),
+		Entries:  entries[start:end],
+	}
+	if cleanPath == "/" {
+		listing.Path = "/"
+	}
+	if page > 1 {
+		listing.PrevPage = page - 1
+	}
+	if page < pages {
+		listing.NextPage = page + 1
+	}
+	return listing
+}
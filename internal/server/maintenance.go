@@ -0,0 +1,208 @@
+package server
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/ezhttp/ezhttp/internal/config"
+	"github.com/ezhttp/ezhttp/internal/logger"
+	"github.com/ezhttp/ezhttp/internal/ratelimit"
+	"github.com/ezhttp/ezhttp/internal/utils"
+)
+
+// Maintenance overrides set by a signal
+const (
+	maintenanceNoOverride int32 = iota
+	maintenanceForcedOn
+	maintenanceForcedOff
+)
+
+// Maintenance tracks whether a site is in maintenance mode. The mode is
+// active when it is enabled in config or the sentinel file exists. A signal
+// overrides that either way until the sentinel file changes again
+type Maintenance struct {
+	configured   bool
+	override     atomic.Int32
+	sentinel     atomic.Bool
+	sentinelFile string
+	retryAfter   string
+	bypassToken  string
+	bypassCookie string
+	bypassHeader string
+	allowNets    []*net.IPNet
+	page         []string
+	pagePath     string // URL path of the page template in the document root
+}
+
+// NewMaintenance creates the maintenance state for a site
+func NewMaintenance(cfg *config.DataConfigMaintenance, rootDir string, placeholder string, manifest *Manifest) (*Maintenance, error) {
+	m := &Maintenance{
+		configured:   cfg.Enabled,
+		sentinelFile: cfg.SentinelFile,
+		bypassToken:  cfg.BypassToken,
+		bypassCookie: cfg.BypassCookie,
+		bypassHeader: cfg.BypassHeader,
+	}
+
+	retryAfter := 5 * time.Minute
+	if cfg.RetryAfter != "" {
+		d, err := time.ParseDuration(cfg.RetryAfter)
+		if err != nil {
+			return nil, fmt.Errorf("invalid retry after: %w", err)
+		}
+		retryAfter = d
+	}
+	m.retryAfter = strconv.Itoa(int(retryAfter.Seconds()))
+
+	for _, cidr := range cfg.AllowCIDRs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid maintenance CIDR %s: %w", cidr, err)
+		}
+		m.allowNets = append(m.allowNets, ipNet)
+	}
+
+	// Maintenance page goes through the same nonce pipeline as the index
+	if cfg.Page != "" {
+		m.pagePath = path.Clean("/" + filepath.ToSlash(cfg.Page))
+		page, err := LoadIndexCache(rootDir, cfg.Page, placeholder, nil, manifest)
+		if errors.Is(err, ErrManifestMismatch) {
+			return nil, fmt.Errorf("failed to load maintenance page: %w", err)
+		}
+		if err != nil {
+			logger.Warn("Maintenance page not found, using plain text", "file", cfg.Page)
+		} else {
+			m.page = page
+		}
+	}
+
+	if m.sentinelFile != "" {
+		m.checkSentinel()
+		go m.sentinelLoop()
+	}
+
+	return m, nil
+}
+
+// Active reports whether maintenance mode is currently on
+func (m *Maintenance) Active() bool {
+	switch m.override.Load() {
+	case maintenanceForcedOn:
+		return true
+	case maintenanceForcedOff:
+		return false
+	}
+	return m.configured || m.sentinel.Load()
+}
+
+// Toggle flips the effective maintenance state, whatever turned it on or
+// off, and returns the new state
+func (m *Maintenance) Toggle() bool {
+	for {
+		old := m.override.Load()
+		active := m.Active()
+		next := maintenanceForcedOn
+		if active {
+			next = maintenanceForcedOff
+		}
+		if m.override.CompareAndSwap(old, next) {
+			return !active
+		}
+	}
+}
+
+// IsPage reports whether urlPath is the maintenance page template
+func (m *Maintenance) IsPage(urlPath string) bool {
+	return m.pagePath != "" && urlPath == m.pagePath
+}
+
+// Bypass reports whether the request may skip maintenance mode
+func (m *Maintenance) Bypass(r *http.Request) bool {
+	if m.bypassToken != "" {
+		if m.bypassHeader != "" {
+			if value := r.Header.Get(m.bypassHeader); value != "" &&
+				subtle.ConstantTimeCompare([]byte(value), []byte(m.bypassToken)) == 1 {
+				return true
+			}
+		}
+		if m.bypassCookie != "" {
+			if cookie, err := r.Cookie(m.bypassCookie); err == nil &&
+				subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(m.bypassToken)) == 1 {
+				return true
+			}
+		}
+	}
+
+	if len(m.allowNets) > 0 {
+		ip := net.ParseIP(ratelimit.ExtractIP(r.RemoteAddr))
+		if ip != nil {
+			for _, ipNet := range m.allowNets {
+				if ipNet.Contains(ip) {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+// Serve writes the 503 maintenance response. The page is rendered like the
+// index, so it should inline its styles and scripts with the nonce placeholder
+func (m *Maintenance) Serve(w http.ResponseWriter, r *http.Request, site *Site) {
+	w.Header().Set("Retry-After", m.retryAfter)
+	w.Header().Set("Cache-Control", "no-store")
+
+	if m.page == nil {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		io.WriteString(w, "Service Unavailable")
+		return
+	}
+
+	nonce := utils.RandStringCharacters(32)
+	if nonce == "" {
+		logger.Error("Failed to generate secure nonce", "type", "security")
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		io.WriteString(w, "Service Unavailable")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", strings.ReplaceAll(site.Csp, "RANDOM", nonce))
+	w.WriteHeader(http.StatusServiceUnavailable)
+	io.WriteString(w, GenerateIndexWithNonce(nonce, m.page, site.Minifier, site.Banner, ""))
+}
+
+// sentinelLoop polls for the sentinel file
+func (m *Maintenance) sentinelLoop() {
+	ticker := time.NewTicker(2 * time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		m.checkSentinel()
+	}
+}
+
+// checkSentinel updates the sentinel state, logging transitions
+func (m *Maintenance) checkSentinel() {
+	_, err := os.Stat(m.sentinelFile)
+	present := err == nil
+	if m.sentinel.Swap(present) != present {
+		// The latest change wins over an earlier signal
+		m.override.Store(maintenanceNoOverride)
+		logger.Info("Maintenance sentinel changed", "file", m.sentinelFile, "maintenance", present)
+	}
+}
@@ -0,0 +1,274 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/ezhttp/ezhttp/internal/logger"
+	"github.com/ezhttp/ezhttp/internal/security"
+	"github.com/ezhttp/ezhttp/internal/utils"
+)
+
+// ManifestEntry describes one file of the document root
+type ManifestEntry struct {
+	Path        string `json:"path"`
+	Size        int64  `json:"size"`
+	SHA256      string `json:"sha256"`
+	ContentType string `json:"content_type"`
+}
+
+// ErrManifestMismatch means a file is missing from the manifest or its
+// content differs from the hash recorded in it
+var ErrManifestMismatch = errors.New("file does not match the manifest")
+
+// Manifest is the set of files a site is allowed to serve, built at startup
+type Manifest struct {
+	entries map[string]ManifestEntry
+}
+
+// SignedManifest is the on-disk format. Signature is the base64 ed25519
+// signature over the exact bytes of Files
+type SignedManifest struct {
+	Files     json.RawMessage `json:"files"`
+	Signature string          `json:"signature"`
+}
+
+// BuildManifest walks rootDir and hashes every servable file. Dotfiles,
+// symlinks and disallowed extensions are skipped, mirroring SecureFileSystem
+func BuildManifest(rootDir string) (*Manifest, error) {
+	m := &Manifest{entries: make(map[string]ManifestEntry)}
+
+	err := filepath.WalkDir(rootDir, func(fullPath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(d.Name(), ".") && fullPath != rootDir {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() || !d.Type().IsRegular() {
+			return nil
+		}
+		ext := filepath.Ext(d.Name())
+		if ext != "" && !security.AllowedExtensions[strings.ToLower(ext)] {
+			return nil
+		}
+
+		relPath, err := filepath.Rel(rootDir, fullPath)
+		if err != nil {
+			return err
+		}
+		entry, err := hashManifestFile(fullPath, "/"+filepath.ToSlash(relPath))
+		if err != nil {
+			return err
+		}
+		m.entries[entry.Path] = entry
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to build manifest: %w", err)
+	}
+
+	return m, nil
+}
+
+// hashManifestFile computes the manifest entry for one file
+func hashManifestFile(fullPath string, urlPath string) (ManifestEntry, error) {
+	file, err := os.Open(fullPath)
+	if err != nil {
+		return ManifestEntry{}, err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return ManifestEntry{}, err
+	}
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return ManifestEntry{}, err
+	}
+
+	contentType, _, _ := utils.GetContentTypeByPath(urlPath)
+	return ManifestEntry{
+		Path:        urlPath,
+		Size:        stat.Size(),
+		SHA256:      hex.EncodeToString(hasher.Sum(nil)),
+		ContentType: contentType,
+	}, nil
+}
+
+// Len returns the number of files in the manifest
+func (m *Manifest) Len() int {
+	return len(m.entries)
+}
+
+// Lookup returns the entry for a clean URL path
+func (m *Manifest) Lookup(urlPath string) (ManifestEntry, bool) {
+	entry, found := m.entries[urlPath]
+	return entry, found
+}
+
+// Verify checks content read outside the file server, such as templates,
+// against the entry for a clean URL path
+func (m *Manifest) Verify(urlPath string, content []byte) error {
+	entry, found := m.entries[urlPath]
+	if !found {
+		return fmt.Errorf("%w: %s is not in the manifest", ErrManifestMismatch, urlPath)
+	}
+	sum := sha256.Sum256(content)
+	if hex.EncodeToString(sum[:]) != entry.SHA256 {
+		return fmt.Errorf("%w: %s does not match its hash", ErrManifestMismatch, urlPath)
+	}
+	return nil
+}
+
+// Entries returns all entries sorted by path
+func (m *Manifest) Entries() []ManifestEntry {
+	entries := make([]ManifestEntry, 0, len(m.entries))
+	for _, entry := range m.entries {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Path < entries[j].Path
+	})
+	return entries
+}
+
+// VerifySigned checks the manifest against a signed manifest file. Files that
+// are missing from the signed manifest or whose hash differs are removed, so
+// they are never served. Returns the number of files removed
+func (m *Manifest) VerifySigned(filename string, publicKey ed25519.PublicKey) (int, error) {
+	fileBytes, err := os.ReadFile(filename)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read signed manifest: %w", err)
+	}
+
+	var signed SignedManifest
+	if err := json.Unmarshal(fileBytes, &signed); err != nil {
+		return 0, fmt.Errorf("failed to parse signed manifest: %w", err)
+	}
+	// Signatures cover the compact encoding, so reformatting the file is harmless
+	var files bytes.Buffer
+	if err := json.Compact(&files, signed.Files); err != nil {
+		return 0, fmt.Errorf("failed to parse signed manifest files: %w", err)
+	}
+	signature, err := base64.StdEncoding.DecodeString(signed.Signature)
+	if err != nil || !ed25519.Verify(publicKey, files.Bytes(), signature) {
+		return 0, fmt.Errorf("signed manifest signature is invalid")
+	}
+
+	var expected []ManifestEntry
+	if err := json.Unmarshal(signed.Files, &expected); err != nil {
+		return 0, fmt.Errorf("failed to parse signed manifest files: %w", err)
+	}
+	expectedByPath := make(map[string]ManifestEntry, len(expected))
+	for _, entry := range expected {
+		expectedByPath[entry.Path] = entry
+	}
+
+	removed := 0
+	for urlPath, entry := range m.entries {
+		want, found := expectedByPath[urlPath]
+		switch {
+		case !found:
+			logger.Warn("File not in signed manifest, refusing to serve", "file", urlPath)
+		case want.SHA256 != entry.SHA256 || want.Size != entry.Size:
+			logger.Warn("File does not match signed manifest, refusing to serve", "file", urlPath)
+		default:
+			continue
+		}
+		delete(m.entries, urlPath)
+		removed++
+	}
+	for urlPath := range expectedByPath {
+		if _, found := m.entries[urlPath]; !found {
+			logger.Warn("File in signed manifest is missing or rejected", "file", urlPath)
+		}
+	}
+
+	return removed, nil
+}
+
+// Sign encodes the manifest in the signed on-disk format
+func (m *Manifest) Sign(privateKey ed25519.PrivateKey) ([]byte, error) {
+	files, err := json.Marshal(m.Entries())
+	if err != nil {
+		return nil, err
+	}
+	signed := SignedManifest{
+		Files:     files,
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(privateKey, files)),
+	}
+	return json.MarshalIndent(signed, "", "  ")
+}
+
+// ManifestFileSystem only opens files present in the manifest whose content
+// still matches the hash recorded at startup. Every open re-hashes the file,
+// so enable the content cache for large or busy sites. A file replaced after
+// the check but before it is read is still served, so the document root must
+// not be writable by untrusted users
+type ManifestFileSystem struct {
+	Fs       http.FileSystem
+	Manifest *Manifest
+}
+
+// Open implements http.FileSystem
+func (mfs *ManifestFileSystem) Open(name string) (http.File, error) {
+	cleanPath := path.Clean("/" + name)
+
+	entry, found := mfs.Manifest.Lookup(cleanPath)
+	if !found {
+		return nil, os.ErrNotExist
+	}
+
+	file, err := mfs.Fs.Open(cleanPath)
+	if err != nil {
+		return nil, err
+	}
+
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	// Size is checked first so truncated or grown files skip the hashing
+	if stat.Size() != entry.Size || !manifestHashMatches(file, entry.SHA256) {
+		file.Close()
+		logger.Warn("File changed since startup, refusing to serve", "file", cleanPath)
+		return nil, os.ErrPermission
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return file, nil
+}
+
+// manifestHashMatches reports whether the remaining content of file hashes to
+// the hex encoded sha256 sum
+func manifestHashMatches(file io.Reader, sum string) bool {
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return false
+	}
+	return hex.EncodeToString(hasher.Sum(nil)) == sum
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Image extensions that can be swapped for a modern sibling
+var negotiableImageExtensions = map[string]bool{
+	".jpg":  true,
+	".jpeg": true,
+	".png":  true,
+	".gif":  true,
+}
+
+// Media types of the modern formats, keyed by file extension
+var modernImageTypes = map[string]string{
+	"avif": "image/avif",
+	"webp": "image/webp",
+}
+
+// ImageNegotiator serves .avif/.webp siblings of images to clients that accept them
+type ImageNegotiator struct {
+	prefixes []string
+	formats  []string // In order of preference, e.g. ["avif", "webp"]
+}
+
+// NewImageNegotiator creates a negotiator for the given path prefixes
+func NewImageNegotiator(prefixes []string, formats []string) *ImageNegotiator {
+	return &ImageNegotiator{
+		prefixes: prefixes,
+		formats:  formats,
+	}
+}
+
+// Negotiable reports whether variants are considered for this path
+func (n *ImageNegotiator) Negotiable(urlPath string) bool {
+	if !negotiableImageExtensions[strings.ToLower(path.Ext(urlPath))] {
+		return false
+	}
+	for _, prefix := range n.prefixes {
+		if strings.HasPrefix(urlPath, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Negotiate returns the best existing variant of urlPath for the request,
+// or urlPath itself. Variants are looked up through the file cache
+func (n *ImageNegotiator) Negotiate(r *http.Request, urlPath string, fileCache *FileExistenceCache) string {
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return urlPath
+	}
+
+	base := strings.TrimSuffix(urlPath, path.Ext(urlPath))
+	for _, format := range n.formats {
+		if !acceptsMediaType(accept, modernImageTypes[format]) {
+			continue
+		}
+		if exists, resolved := fileCache.CheckPath(base + "." + format); exists && resolved == base+"."+format {
+			return resolved
+		}
+	}
+	return urlPath
+}
+
+// acceptsMediaType reports whether the Accept header explicitly lists the
+// media type with a non-zero quality. Wildcards are ignored on purpose, since
+// "image/*" does not mean a browser can decode AVIF
+func acceptsMediaType(accept string, mediaType string) bool {
+	for _, part := range strings.Split(accept, ",") {
+		candidate, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if !strings.EqualFold(strings.TrimSpace(candidate), mediaType) {
+			continue
+		}
+		for _, param := range strings.Split(params, ";") {
+			if qValue, found := strings.CutPrefix(strings.TrimSpace(param), "q="); found {
+				if q, err := strconv.ParseFloat(qValue, 64); err == nil && q == 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
@@ -0,0 +1,355 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ezhttp/ezhttp/internal/config"
+	"github.com/ezhttp/ezhttp/internal/logger"
+	"golang.org/x/image/draw"
+)
+
+// Source formats that can be resized, keyed by file extension
+var resizableImageFormats = map[string]string{
+	".jpg":  "jpeg",
+	".jpeg": "jpeg",
+	".png":  "png",
+}
+
+// errNoResize means the original should be served as is
+var errNoResize = errors.New("image does not need resizing")
+
+// ImageResizer serves resized renditions of JPEG and PNG images for
+// "?w=<width>&q=<quality>" requests. Renditions are written to a cache
+// directory and the least recently used ones are removed once the byte
+// budget is exceeded
+type ImageResizer struct {
+	prefixes        []string
+	widths          map[int]bool
+	qualities       map[int]bool
+	defaultQuality  int
+	maxSourcePixels int64
+	fs              http.FileSystem
+	slots           chan struct{}
+
+	cacheDir      string
+	cacheMaxBytes int64
+	mu            sync.Mutex
+	renditions    map[string]*rendition
+	cacheBytes    int64
+}
+
+type rendition struct {
+	size     int64
+	lastUsed time.Time
+}
+
+// NewImageResizer creates a resizer reading sources through fs and keeping
+// renditions in cacheDir. Renditions left by a previous run are reused
+func NewImageResizer(cfg *config.DataConfigImageResize, fs http.FileSystem, cacheDir string) (*ImageResizer, error) {
+	if err := os.MkdirAll(cacheDir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create image cache directory: %w", err)
+	}
+
+	ir := &ImageResizer{
+		prefixes:        cfg.Prefixes,
+		widths:          make(map[int]bool),
+		qualities:       make(map[int]bool),
+		defaultQuality:  cfg.DefaultQuality,
+		maxSourcePixels: cfg.MaxSourcePixels,
+		fs:              fs,
+		slots:           make(chan struct{}, cfg.MaxConcurrent),
+		cacheDir:        cacheDir,
+		cacheMaxBytes:   cfg.CacheMaxBytes,
+		renditions:      make(map[string]*rendition),
+	}
+	for _, width := range cfg.Widths {
+		ir.widths[width] = true
+	}
+	for _, quality := range cfg.Qualities {
+		ir.qualities[quality] = true
+	}
+	ir.qualities[cfg.DefaultQuality] = true
+
+	entries, err := os.ReadDir(cacheDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image cache directory: %w", err)
+	}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		if strings.HasPrefix(entry.Name(), ".") {
+			// Leftover from an interrupted write
+			os.Remove(filepath.Join(cacheDir, entry.Name()))
+			continue
+		}
+		ir.renditions[entry.Name()] = &rendition{size: info.Size(), lastUsed: info.ModTime()}
+		ir.cacheBytes += info.Size()
+	}
+
+	ir.mu.Lock()
+	ir.evictLocked()
+	ir.mu.Unlock()
+
+	return ir, nil
+}
+
+// Resizable reports whether resizing is considered for this path
+func (ir *ImageResizer) Resizable(urlPath string) bool {
+	if _, ok := resizableImageFormats[strings.ToLower(path.Ext(urlPath))]; !ok {
+		return false
+	}
+	for _, prefix := range ir.prefixes {
+		if strings.HasPrefix(urlPath, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Serve writes the rendition requested by the w and q query parameters.
+// Sizes outside the allowlist are rejected with 400. It returns false without
+// writing anything when the original should be served instead, e.g. when the
+// requested width is not smaller than the image. The caller sets Content-Type
+// and Cache-Control beforehand
+func (ir *ImageResizer) Serve(w http.ResponseWriter, r *http.Request, urlPath string) bool {
+	query := r.URL.Query()
+	width, err := strconv.Atoi(query.Get("w"))
+	if err != nil || !ir.widths[width] {
+		writeResizeError(w, "Unsupported image width", http.StatusBadRequest)
+		return true
+	}
+	quality := ir.defaultQuality
+	if q := query.Get("q"); q != "" {
+		quality, err = strconv.Atoi(q)
+		if err != nil || !ir.qualities[quality] {
+			writeResizeError(w, "Unsupported image quality", http.StatusBadRequest)
+			return true
+		}
+	}
+
+	file, err := ir.fs.Open(urlPath)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil || stat.IsDir() {
+		return false
+	}
+
+	format := resizableImageFormats[strings.ToLower(path.Ext(urlPath))]
+	if format == "png" {
+		// PNG is lossless, so every quality yields the same rendition
+		quality = 0
+	}
+	name := renditionName(urlPath, stat, width, quality) + path.Ext(urlPath)
+
+	if ir.serveCached(w, r, name, stat.ModTime()) {
+		return true
+	}
+
+	// Reading the header is cheap and avoids decoding images we will not resize
+	imageConfig, _, err := image.DecodeConfig(file)
+	if err != nil {
+		logger.Warn("Failed to read image header", "path", urlPath, "error", err)
+		return false
+	}
+	if width >= imageConfig.Width {
+		return false
+	}
+	if int64(imageConfig.Width)*int64(imageConfig.Height) > ir.maxSourcePixels {
+		logger.Warn("Image too large to resize", "path", urlPath, "width", imageConfig.Width, "height", imageConfig.Height)
+		return false
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return false
+	}
+
+	// Limit CPU and memory spent on resizing
+	select {
+	case ir.slots <- struct{}{}:
+	case <-r.Context().Done():
+		// The client gave up waiting
+		writeResizeError(w, "Service Unavailable", http.StatusServiceUnavailable)
+		return true
+	}
+	defer func() { <-ir.slots }()
+
+	// Another request may have produced the rendition while we waited
+	if ir.serveCached(w, r, name, stat.ModTime()) {
+		return true
+	}
+
+	start := time.Now()
+	body, err := resizeImage(file, format, width, quality)
+	if errors.Is(err, errNoResize) {
+		return false
+	}
+	if err != nil {
+		logger.Warn("Failed to resize image", "path", urlPath, "error", err)
+		return false
+	}
+	logger.Debug("Resized image",
+		"path", urlPath,
+		"width", width,
+		"quality", quality,
+		"bytes", len(body),
+		"duration", time.Since(start))
+
+	ir.store(name, body)
+
+	w.Header().Set("ETag", renditionETag(name))
+	http.ServeContent(w, r, name, stat.ModTime(), bytes.NewReader(body))
+	return true
+}
+
+// writeResizeError writes an error response. The immutable Cache-Control set
+// by the caller must not apply to it, or caches would keep the error
+func writeResizeError(w http.ResponseWriter, message string, status int) {
+	w.Header().Set("Cache-Control", "no-store")
+	http.Error(w, message, status)
+}
+
+// serveCached writes a rendition from the cache directory if present
+func (ir *ImageResizer) serveCached(w http.ResponseWriter, r *http.Request, name string, modTime time.Time) bool {
+	file, err := os.Open(filepath.Join(ir.cacheDir, name))
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	ir.mu.Lock()
+	if entry, found := ir.renditions[name]; found {
+		entry.lastUsed = time.Now()
+	}
+	ir.mu.Unlock()
+
+	w.Header().Set("ETag", renditionETag(name))
+	http.ServeContent(w, r, name, modTime, file)
+	return true
+}
+
+// store writes a rendition to the cache directory, evicting least recently
+// used renditions over budget. Failures only cost a resize on the next request
+func (ir *ImageResizer) store(name string, body []byte) {
+	if int64(len(body)) > ir.cacheMaxBytes {
+		return
+	}
+
+	// Write to a temporary file first so readers never see partial images
+	tmp, err := os.CreateTemp(ir.cacheDir, ".rendition-*")
+	if err != nil {
+		logger.Warn("Failed to cache resized image", "error", err)
+		return
+	}
+	_, errWrite := tmp.Write(body)
+	errClose := tmp.Close()
+	if errWrite != nil || errClose != nil {
+		os.Remove(tmp.Name())
+		logger.Warn("Failed to cache resized image", "error", errors.Join(errWrite, errClose))
+		return
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(ir.cacheDir, name)); err != nil {
+		os.Remove(tmp.Name())
+		logger.Warn("Failed to cache resized image", "error", err)
+		return
+	}
+
+	ir.mu.Lock()
+	defer ir.mu.Unlock()
+
+	if old, found := ir.renditions[name]; found {
+		ir.cacheBytes -= old.size
+	}
+	ir.renditions[name] = &rendition{size: int64(len(body)), lastUsed: time.Now()}
+	ir.cacheBytes += int64(len(body))
+	ir.evictLocked()
+}
+
+// evictLocked removes least recently used renditions until the cache fits
+// its budget. Must be called with the lock held
+func (ir *ImageResizer) evictLocked() {
+	evicted := 0
+	for ir.cacheBytes > ir.cacheMaxBytes && len(ir.renditions) > 0 {
+		var oldestName string
+		var oldest *rendition
+		for name, entry := range ir.renditions {
+			if oldest == nil || entry.lastUsed.Before(oldest.lastUsed) {
+				oldestName, oldest = name, entry
+			}
+		}
+		if err := os.Remove(filepath.Join(ir.cacheDir, oldestName)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			logger.Warn("Failed to remove cached image", "file", oldestName, "error", err)
+		}
+		delete(ir.renditions, oldestName)
+		ir.cacheBytes -= oldest.size
+		evicted++
+	}
+	if evicted > 0 {
+		logger.Debug("Evicted resized images", "count", evicted, "bytes", ir.cacheBytes)
+	}
+}
+
+// renditionName identifies a rendition of a specific version of the source
+func renditionName(urlPath string, stat os.FileInfo, width int, quality int) string {
+	sum := sha256.Sum256(fmt.Appendf(nil, "%s\n%d\n%d\n%d\n%d", urlPath, stat.Size(), stat.ModTime().UnixNano(), width, quality))
+	return hex.EncodeToString(sum[:16])
+}
+
+func renditionETag(name string) string {
+	return `"` + strings.TrimSuffix(name, path.Ext(name)) + `"`
+}
+
+// resizeImage decodes src, scales it to width keeping the aspect ratio and
+// encodes it in the same format
+func resizeImage(src io.Reader, format string, width int, quality int) ([]byte, error) {
+	img, _, err := image.Decode(src)
+	if err != nil {
+		return nil, err
+	}
+
+	bounds := img.Bounds()
+	if width >= bounds.Dx() {
+		return nil, errNoResize
+	}
+	height := bounds.Dy() * width / bounds.Dx()
+	if height < 1 {
+		height = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, bounds, draw.Src, nil)
+
+	var buf bytes.Buffer
+	switch format {
+	case "jpeg":
+		err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: quality})
+	case "png":
+		err = png.Encode(&buf, dst)
+	default:
+		err = fmt.Errorf("unsupported format: %s", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,295 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ezhttp/ezhttp/internal/config"
+	"github.com/ezhttp/ezhttp/internal/logger"
+	"github.com/ezhttp/ezhttp/internal/middleware"
+	"github.com/ezhttp/ezhttp/internal/ratelimit"
+	"github.com/ezhttp/ezhttp/internal/security"
+	"github.com/tdewolff/minify/v2"
+)
+
+// Site holds everything needed to serve one virtual host
+type Site struct {
+	Name      string
+	Hosts     []string
+	Default   bool
+	RootDir   string
+	FileCache *FileExistenceCache
+	Csp       string
+	Index     []string
+	Banner    []string
+	Headers   map[string]string
+	Minifier  *minify.M
+
+	// ClientConfig is the pre-encoded JSON injected into the index
+	ClientConfig string
+
+	// EarlyHints are sent as Link headers and a 103 response for the index
+	EarlyHints []EarlyHint
+
+	Maintenance *Maintenance
+
+	// URLSigners protect path prefixes with signed, expiring links
+	URLSigners []*security.URLSigner
+
+	// Auth is nil when no path requires authentication
+	Auth *BasicAuth
+
+	// ContentCache is nil unless the in-memory cache is enabled
+	ContentCache *ContentCache
+
+	// Manifest is nil unless startup manifests are enabled
+	Manifest *Manifest
+
+	// ImageNegotiator is nil unless image negotiation prefixes are configured
+	ImageNegotiator *ImageNegotiator
+
+	// Languages is nil unless localized index templates are loaded
+	Languages *LanguageNegotiator
+
+	// ABTest is nil unless index variants are configured
+	ABTest *ABTest
+
+	// Lister is nil unless directory listing prefixes are configured
+	Lister *DirectoryLister
+
+	// ImageResizer is nil unless image resize prefixes are configured
+	ImageResizer *ImageResizer
+
+	httpfs  http.Handler
+	handler http.Handler
+}
+
+// NewSite builds a site from its effective configuration
+func NewSite(cfg config.DataConfigSite, minifier *minify.M) (*Site, error) {
+	rootDir, err := filepath.Abs(cfg.DocumentRoot)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve document root: %w", err)
+	}
+	if info, err := os.Stat(rootDir); err != nil || !info.IsDir() {
+		return nil, fmt.Errorf("document root is not a directory: %s", cfg.DocumentRoot)
+	}
+
+	site := &Site{
+		Name:     cfg.Name,
+		Hosts:    cfg.Hosts,
+		Default:  cfg.Default,
+		RootDir:  rootDir,
+		Csp:      cfg.Csp.Compile(),
+		Banner:   cfg.Banner,
+		Headers:  cfg.Headers,
+		Minifier: minifier,
+	}
+
+	// Use a custom FileSystem that prevents directory listings and symlink attacks
+	secureFs := &security.SecureFileSystem{
+		Fs:      http.Dir(rootDir),
+		BaseDir: rootDir,
+	}
+	var fileSystem http.FileSystem = secureFs
+
+	// Restrict serving to the files hashed (and optionally verified) at startup.
+	// Built first so the templates below are checked against it too
+	if cfg.Manifest != nil && cfg.Manifest.Enabled {
+		site.Manifest, err = loadSiteManifest(cfg.Manifest, rootDir)
+		if err != nil {
+			return nil, err
+		}
+		fileSystem = &ManifestFileSystem{Fs: fileSystem, Manifest: site.Manifest}
+		logger.Info("Manifest enabled", "site", site.Name, "files", site.Manifest.Len())
+	}
+	site.httpfs = http.FileServer(fileSystem)
+
+	// Cache Generated Index
+	site.Index, err = LoadIndexCache(rootDir, cfg.IndexFile, cfg.NoncePlaceholder, cfg.Sri, site.Manifest)
+	if err != nil {
+		if errors.Is(err, ErrManifestMismatch) {
+			return nil, fmt.Errorf("failed to load index template: %w", err)
+		}
+		if cfg.Sri != nil && cfg.Sri.Enabled && cfg.Sri.FailOnMissing && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to load index template: %w", err)
+		}
+		logger.Warn("Failed to load index template", "site", site.Name, "file", cfg.IndexFile, "error", err)
+	}
+
+	if cfg.EarlyHints != nil && *cfg.EarlyHints {
+		site.EarlyHints = ExtractEarlyHints(strings.Join(site.Index, cfg.NoncePlaceholder), cfg.NoncePlaceholder)
+		logger.Info("Early hints enabled", "site", site.Name, "links", len(site.EarlyHints))
+	}
+
+	if cfg.Languages != nil && len(cfg.Languages.Available) > 0 {
+		templates, err := LoadIndexTemplates(rootDir, cfg.IndexFile, cfg.Languages.Available, cfg.NoncePlaceholder, cfg.Sri, site.Manifest)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load localized index templates: %w", err)
+		}
+		earlyHints := cfg.EarlyHints != nil && *cfg.EarlyHints
+		site.Languages = NewLanguageNegotiator(cfg.Languages, templates, site.Index, earlyHints, cfg.NoncePlaceholder)
+		if site.Languages != nil {
+			logger.Info("Localized index enabled", "site", site.Name, "languages", site.Languages.Languages())
+		} else {
+			logger.Warn("Not enough localized index templates, serving the plain index", "site", site.Name)
+		}
+	}
+
+	if cfg.IndexVariants != nil {
+		site.ABTest, err = NewABTest(cfg.IndexVariants, rootDir, cfg.NoncePlaceholder, cfg.Sri, site.Manifest, cfg.EarlyHints != nil && *cfg.EarlyHints)
+		if err != nil {
+			return nil, err
+		}
+		if site.ABTest != nil {
+			logger.Info("Index variants enabled", "site", site.Name, "variants", site.ABTest.Variants())
+		}
+	}
+
+	site.ClientConfig, err = MarshalClientConfig(cfg.ClientConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode client config: %w", err)
+	}
+
+	site.Maintenance, err = NewMaintenance(cfg.Maintenance, rootDir, cfg.NoncePlaceholder, site.Manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, signed := range cfg.SignedURLs {
+		site.URLSigners = append(site.URLSigners, security.NewURLSigner(signed.Prefix, signed.Secret, signed.BindIP))
+	}
+
+	site.Auth, err = NewBasicAuth(cfg.Auth)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.ContentCache != nil && cfg.ContentCache.Enabled {
+		revalidate := 2 * time.Second
+		if cfg.ContentCache.RevalidateInterval != "" {
+			if d, err := time.ParseDuration(cfg.ContentCache.RevalidateInterval); err == nil {
+				revalidate = d
+			}
+		}
+		site.ContentCache = NewContentCache(fileSystem, cfg.ContentCache.MaxBytes, cfg.ContentCache.MaxFileSize, revalidate)
+		logger.Info("Content cache enabled",
+			"site", site.Name,
+			"max_bytes", cfg.ContentCache.MaxBytes,
+			"max_file_size", cfg.ContentCache.MaxFileSize)
+	}
+
+	// Create file existence cache
+	positiveTTL := 5 * time.Minute
+	negativeTTL := 10 * time.Second
+	maxEntries := 10000
+	if cfg.FileCache != nil {
+		if d, err := time.ParseDuration(cfg.FileCache.PositiveTTL); err == nil {
+			positiveTTL = d
+		}
+		if d, err := time.ParseDuration(cfg.FileCache.NegativeTTL); err == nil {
+			negativeTTL = d
+		}
+		if cfg.FileCache.MaxEntries > 0 {
+			maxEntries = cfg.FileCache.MaxEntries
+		}
+	}
+	site.FileCache, err = NewFileExistenceCache(rootDir, positiveTTL, negativeTTL, maxEntries)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create file cache: %w", err)
+	}
+	if site.Manifest != nil {
+		site.FileCache.SetManifest(site.Manifest)
+	} else if cfg.FileCache == nil || cfg.FileCache.WatchOrDefault() {
+		if err := site.FileCache.Watch(); err != nil {
+			// Still correct without events, entries just live until their TTL
+			logger.Warn("Failed to watch document root, relying on TTLs", "site", site.Name, "error", err)
+		}
+	}
+	if cfg.FileCache != nil && cfg.FileCache.StatsInterval != "" {
+		if interval, err := time.ParseDuration(cfg.FileCache.StatsInterval); err == nil && interval > 0 {
+			go site.FileCache.LogStats(site.Name, interval)
+		}
+	}
+	// Pre-warm cache with common paths
+	site.FileCache.PrewarmCommonPaths()
+
+	if cfg.ImageNegotiation != nil && len(cfg.ImageNegotiation.Prefixes) > 0 && len(cfg.ImageNegotiation.Formats) > 0 {
+		site.ImageNegotiator = NewImageNegotiator(cfg.ImageNegotiation.Prefixes, cfg.ImageNegotiation.Formats)
+	}
+
+	if cfg.DirectoryListing != nil && len(cfg.DirectoryListing.Prefixes) > 0 {
+		// Only the lister may open directories, http.FileServer would list
+		// them without filtering. Manifests only know files, so it reads the
+		// document root directly
+		listFs := &security.SecureFileSystem{
+			Fs:           http.Dir(rootDir),
+			BaseDir:      rootDir,
+			ListPrefixes: cfg.DirectoryListing.Prefixes,
+		}
+		site.Lister = NewDirectoryLister(cfg.DirectoryListing.Prefixes, listFs, site.Manifest, cfg.DirectoryListing.PageSize)
+		logger.Info("Directory listings enabled", "site", site.Name, "prefixes", cfg.DirectoryListing.Prefixes)
+	}
+
+	if cfg.ImageResize != nil && len(cfg.ImageResize.Prefixes) > 0 {
+		// Sites get their own directory so identical paths never collide
+		site.ImageResizer, err = NewImageResizer(cfg.ImageResize, fileSystem, filepath.Join(cfg.ImageResize.CacheDir, site.Name))
+		if err != nil {
+			return nil, err
+		}
+		logger.Info("Image resizing enabled", "site", site.Name, "widths", cfg.ImageResize.Widths)
+	}
+
+	var handler http.Handler = MwNonce(site)
+
+	// Apply rate limiting if enabled
+	if cfg.RateLimit != nil && cfg.RateLimit.Enabled {
+		limiter := ratelimit.NewLimiter(
+			cfg.RateLimit.RequestsPerMinute,
+			cfg.RateLimit.BurstSize,
+		)
+		handler = middleware.RateLimitMiddleware(limiter)(handler)
+		logger.Info("Rate limiting enabled",
+			"site", site.Name,
+			"requests_per_minute", cfg.RateLimit.RequestsPerMinute,
+			"burst_size", cfg.RateLimit.BurstSize)
+	}
+	site.handler = handler
+
+	return site, nil
+}
+
+// loadSiteManifest builds the manifest and verifies it against the signed one
+func loadSiteManifest(cfg *config.DataConfigManifest, rootDir string) (*Manifest, error) {
+	manifest, err := BuildManifest(rootDir)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.SignedFile != "" {
+		publicKey, err := base64.StdEncoding.DecodeString(cfg.PublicKey)
+		if err != nil || len(publicKey) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid manifest public key")
+		}
+		removed, err := manifest.VerifySigned(cfg.SignedFile, ed25519.PublicKey(publicKey))
+		if err != nil {
+			return nil, err
+		}
+		if removed > 0 && cfg.Strict {
+			return nil, fmt.Errorf("%d files failed manifest verification", removed)
+		}
+	}
+
+	return manifest, nil
+}
+
+// ServeHTTP serves a request for this site
+func (s *Site) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.handler.ServeHTTP(w, r)
+}
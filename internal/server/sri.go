@@ -0,0 +1,129 @@
+package server
+
+import (
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/ezhttp/ezhttp/internal/config"
+	"github.com/ezhttp/ezhttp/internal/logger"
+)
+
+// Matches opening <script> and <link> tags, including multi-line ones
+var sriTagPattern = regexp.MustCompile(`(?is)<(script|link)\b[^>]*>`)
+
+// Matches name="value", name='value' and name=value attributes
+var htmlAttrPattern = regexp.MustCompile(`(?s)([a-zA-Z_:][-a-zA-Z0-9_:.]*)\s*=\s*("[^"]*"|'[^']*'|[^\s"'=<>` + "`" + `]+)`)
+
+// parseTagAttrs returns the lowercased attribute names and unquoted values of a tag
+func parseTagAttrs(tag string) map[string]string {
+	attrs := make(map[string]string)
+	for _, m := range htmlAttrPattern.FindAllStringSubmatch(tag, -1) {
+		value := m[2]
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') {
+			value = value[1 : len(value)-1]
+		}
+		attrs[strings.ToLower(m[1])] = value
+	}
+	return attrs
+}
+
+// isLocalAssetRef reports whether a src/href points into the document root
+func isLocalAssetRef(ref string) bool {
+	if ref == "" || strings.HasPrefix(ref, "//") || strings.HasPrefix(ref, "#") {
+		return false
+	}
+	// Anything with a scheme (https:, data:, blob:) is not local
+	if i := strings.IndexAny(ref, ":/?#"); i >= 0 && ref[i] == ':' {
+		return false
+	}
+	return true
+}
+
+// resolveLocalAsset maps a local src/href to a clean, root-relative path
+func resolveLocalAsset(ref string) (string, bool) {
+	if i := strings.IndexAny(ref, "?#"); i >= 0 {
+		ref = ref[:i]
+	}
+	if strings.Contains(ref, "..") {
+		return "", false
+	}
+	return path.Clean("/" + ref), true
+}
+
+// ApplySubresourceIntegrity adds sha384 integrity and crossorigin attributes
+// to local <script src> and <link rel=stylesheet> references in an index
+// template. Hashes are computed once, so assets must be immutable (versioned
+// paths) for the template's lifetime. Remote assets without integrity are
+// logged unless WarnRemote is false, and missing local assets are an error when
+// FailOnMissing is set
+func ApplySubresourceIntegrity(html string, rootDir string, sri *config.DataConfigSri) (string, error) {
+	var firstErr error
+
+	result := sriTagPattern.ReplaceAllStringFunc(html, func(tag string) string {
+		if firstErr != nil {
+			return tag
+		}
+
+		attrs := parseTagAttrs(tag)
+		var ref string
+		if strings.HasPrefix(strings.ToLower(tag), "<script") {
+			ref = attrs["src"]
+		} else if strings.EqualFold(attrs["rel"], "stylesheet") {
+			ref = attrs["href"]
+		}
+		if ref == "" {
+			return tag
+		}
+
+		if !isLocalAssetRef(ref) {
+			if _, hasIntegrity := attrs["integrity"]; !hasIntegrity && sri.WarnRemoteOrDefault() {
+				logger.Warn("Remote asset without integrity attribute", "url", ref)
+			}
+			return tag
+		}
+
+		if _, hasIntegrity := attrs["integrity"]; hasIntegrity {
+			return tag
+		}
+
+		assetPath, ok := resolveLocalAsset(ref)
+		if !ok {
+			logger.Warn("Skipping SRI for invalid asset reference", "ref", ref)
+			return tag
+		}
+
+		content, err := os.ReadFile(filepath.Join(rootDir, filepath.FromSlash(assetPath)))
+		if err != nil {
+			if sri.FailOnMissing {
+				firstErr = fmt.Errorf("referenced asset not found: %s", assetPath)
+			} else {
+				logger.Warn("Referenced asset not found, skipping SRI", "ref", assetPath)
+			}
+			return tag
+		}
+
+		sum := sha512.Sum384(content)
+		injected := ` integrity="sha384-` + base64.StdEncoding.EncodeToString(sum[:]) + `"`
+		if _, hasCrossOrigin := attrs["crossorigin"]; !hasCrossOrigin {
+			injected += ` crossorigin="anonymous"`
+		}
+
+		// Insert before the closing ">" or "/>"
+		end := len(tag) - 1
+		if end > 0 && tag[end-1] == '/' {
+			end--
+		}
+		return strings.TrimRight(tag[:end], " \t\r\n") + injected + tag[end:]
+	})
+
+	if firstErr != nil {
+		return "", firstErr
+	}
+	return result, nil
+}
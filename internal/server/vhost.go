@@ -0,0 +1,88 @@
+package server
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/ezhttp/ezhttp/internal/logger"
+	"github.com/ezhttp/ezhttp/internal/ratelimit"
+)
+
+// HostRouter dispatches requests to sites based on the Host header
+type HostRouter struct {
+	exact     map[string]*Site
+	wildcards []wildcardSite
+	fallback  *Site
+}
+
+type wildcardSite struct {
+	suffix string // ".example.com" for "*.example.com"
+	site   *Site
+}
+
+// NewHostRouter creates a router over the given sites
+func NewHostRouter(sites []*Site) *HostRouter {
+	hr := &HostRouter{
+		exact: make(map[string]*Site),
+	}
+
+	for _, site := range sites {
+		if site.Default {
+			hr.fallback = site
+		}
+		for _, host := range site.Hosts {
+			host = normalizeHost(host)
+			if strings.HasPrefix(host, "*.") {
+				hr.wildcards = append(hr.wildcards, wildcardSite{suffix: host[1:], site: site})
+			} else {
+				hr.exact[host] = site
+			}
+		}
+	}
+
+	// Most specific wildcard wins
+	sort.SliceStable(hr.wildcards, func(i, j int) bool {
+		return len(hr.wildcards[i].suffix) > len(hr.wildcards[j].suffix)
+	})
+
+	return hr
+}
+
+// Match returns the site serving the given host, or nil if there is none
+func (hr *HostRouter) Match(host string) *Site {
+	host = normalizeHost(host)
+
+	if site, ok := hr.exact[host]; ok {
+		return site
+	}
+	for _, wc := range hr.wildcards {
+		if strings.HasSuffix(host, wc.suffix) && len(host) > len(wc.suffix) {
+			return wc.site
+		}
+	}
+	return hr.fallback
+}
+
+// ServeHTTP implements http.Handler
+func (hr *HostRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	site := hr.Match(r.Host)
+	if site == nil {
+		logger.Warn("No site for host", "host", r.Host, "ip", ratelimit.ExtractIP(r.RemoteAddr))
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusMisdirectedRequest)
+		io.WriteString(w, "Misdirected Request")
+		return
+	}
+	site.ServeHTTP(w, r)
+}
+
+// normalizeHost lowercases the host and strips any port and trailing dot
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
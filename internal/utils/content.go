@@ -58,6 +58,9 @@ func GetContentTypeByPath(path string) (string, bool, bool) {
 	case "webp":
 		contentType = "image/webp"
 		cacheable = true
+	case "avif":
+		contentType = "image/avif"
+		cacheable = true
 	case "woff2":
 		contentType = "font/woff2; charset=utf-8"
 	}